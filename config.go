@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Config holds everything needed to start an eternity server. Values are
+// taken from, in increasing order of priority: the defaults, the config
+// file, ETERNITY_* environment variables and command line flags.
+type Config struct {
+	DataDir string `json:"datadir"` // where eternityFS keeps files and its config
+	NymURI  string `json:"nymuri"`  // websocket of the nym native client
+
+	// when set public files are also served over HTTP on this address
+	HTTPListen string `json:"httplisten"`
+
+	// when set the server starts nym-client itself
+	LaunchNymClient bool   `json:"launchnymclient"`
+	NymBinary       string `json:"nymbinary"`
+	NymID           string `json:"nymid"`
+	NymGateway      string `json:"nymgateway"`
+
+	NymArgs        []string `json:"nymargs"`        // extra arguments for nym-client run
+	NymMaxRestarts int      `json:"nymmaxrestarts"` // crashes in a row before giving up, 0 never gives up
+}
+
+type InvalidConfigError struct {
+	Field  string
+	Reason string
+}
+
+func (e *InvalidConfigError) Error() string {
+	return fmt.Sprintf("invalid config: %s %s", e.Field, e.Reason)
+}
+
+func defaultConfig() Config {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	return Config{
+		DataDir:    filepath.Join(home, "eternity"),
+		NymURI:     "ws://localhost:1977",
+		NymBinary:  "nym/target/release/nym-client",
+		NymID:      "eternClient",
+		NymGateway: "6LdVTJhRfJKsrUtnjFqE3TpEbCYs3VZoxmaoNFqRWn4x",
+	}
+}
+
+// configOption ties a config value to its flag and environment variable
+type configOption struct {
+	flag  string
+	env   string
+	usage string
+	str   *string
+	boolV *bool
+	intV  *int
+	list  *[]string // space separated on the command line and in the environment
+}
+
+func (c *Config) options() []configOption {
+	return []configOption{
+		{flag: "data-dir", env: "ETERNITY_DATA_DIR", usage: "directory for stored files and the eternityFS config", str: &c.DataDir},
+		{flag: "nym-uri", env: "ETERNITY_NYM_URI", usage: "websocket URI of the nym native client", str: &c.NymURI},
+		{flag: "http-listen", env: "ETERNITY_HTTP_LISTEN", usage: "host:port to serve public files over HTTP on, off when empty", str: &c.HTTPListen},
+		{flag: "launch-nym-client", env: "ETERNITY_LAUNCH_NYM_CLIENT", usage: "start nym-client from this process", boolV: &c.LaunchNymClient},
+		{flag: "nym-binary", env: "ETERNITY_NYM_BINARY", usage: "path to the nym-client binary", str: &c.NymBinary},
+		{flag: "nym-id", env: "ETERNITY_NYM_ID", usage: "nym-client id to run", str: &c.NymID},
+		{flag: "nym-gateway", env: "ETERNITY_NYM_GATEWAY", usage: "identity key of the gateway nym-client connects to", str: &c.NymGateway},
+		{flag: "nym-args", env: "ETERNITY_NYM_ARGS", usage: "extra arguments for nym-client run, space separated", list: &c.NymArgs},
+		{flag: "nym-max-restarts", env: "ETERNITY_NYM_MAX_RESTARTS", usage: "nym-client crashes in a row before the server gives up, 0 for never", intV: &c.NymMaxRestarts},
+	}
+}
+
+func (o configOption) set(value string) error {
+	switch {
+	case o.str != nil:
+		*o.str = value
+	case o.list != nil:
+		*o.list = strings.Fields(value)
+	case o.intV != nil:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return &InvalidConfigError{Field: o.flag, Reason: "must be a number"}
+		}
+		*o.intV = n
+	default:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return &InvalidConfigError{Field: o.flag, Reason: "must be true or false"}
+		}
+		*o.boolV = b
+	}
+	return nil
+}
+
+// value is the option as it is set on the command line
+func (o configOption) value() string {
+	switch {
+	case o.str != nil:
+		return *o.str
+	case o.list != nil:
+		return strings.Join(*o.list, " ")
+	case o.intV != nil:
+		return strconv.Itoa(*o.intV)
+	}
+	return strconv.FormatBool(*o.boolV)
+}
+
+// loadConfig builds the config from the defaults, the config file, the
+// environment and the given command line arguments
+func loadConfig(name string, args []string) (Config, error) {
+	cfg := defaultConfig()
+
+	// flags are parsed into their own values first so we know which ones
+	// were given, they are applied last
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("ETERNITY_CONFIG"), "JSON config file (env ETERNITY_CONFIG)")
+	for _, o := range cfg.options() {
+		usage := fmt.Sprintf("%s (env %s)", o.usage, o.env)
+		switch {
+		case o.boolV != nil:
+			fs.Bool(o.flag, *o.boolV, usage)
+		case o.intV != nil:
+			fs.Int(o.flag, *o.intV, usage)
+		default:
+			fs.String(o.flag, o.value(), usage)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if fs.NArg() > 0 {
+		return Config{}, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	if *configPath != "" {
+		raw, err := ioutil.ReadFile(*configPath)
+		if err != nil {
+			return Config{}, err
+		}
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return Config{}, fmt.Errorf("reading config file %s: %w", *configPath, err)
+		}
+	}
+
+	options := cfg.options()
+	for _, o := range options {
+		if value, ok := os.LookupEnv(o.env); ok {
+			if err := o.set(value); err != nil {
+				return Config{}, err
+			}
+		}
+	}
+
+	var setErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, o := range options {
+			if o.flag == f.Name && setErr == nil {
+				setErr = o.set(f.Value.String())
+			}
+		}
+	})
+	if setErr != nil {
+		return Config{}, setErr
+	}
+
+	if err := cfg.validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) validate() error {
+	if c.DataDir == "" {
+		return &InvalidConfigError{Field: "data-dir", Reason: "must not be empty"}
+	}
+	dataDir, err := filepath.Abs(c.DataDir)
+	if err != nil {
+		return &InvalidConfigError{Field: "data-dir", Reason: err.Error()}
+	}
+	c.DataDir = dataDir
+	if info, err := os.Stat(dataDir); err == nil && !info.IsDir() {
+		return &InvalidConfigError{Field: "data-dir", Reason: "is not a directory"}
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return &InvalidConfigError{Field: "data-dir", Reason: err.Error()}
+	}
+
+	u, err := url.Parse(c.NymURI)
+	if err != nil {
+		return &InvalidConfigError{Field: "nym-uri", Reason: err.Error()}
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return &InvalidConfigError{Field: "nym-uri", Reason: "must be a ws:// or wss:// URI"}
+	}
+	if u.Hostname() == "" {
+		return &InvalidConfigError{Field: "nym-uri", Reason: "must have a host"}
+	}
+
+	if c.HTTPListen != "" {
+		if _, _, err := net.SplitHostPort(c.HTTPListen); err != nil {
+			return &InvalidConfigError{Field: "http-listen", Reason: err.Error()}
+		}
+	}
+
+	if c.LaunchNymClient {
+		if c.NymBinary == "" {
+			return &InvalidConfigError{Field: "nym-binary", Reason: "must be set to launch nym-client"}
+		}
+		if c.NymID == "" {
+			return &InvalidConfigError{Field: "nym-id", Reason: "must be set to launch nym-client"}
+		}
+		if c.NymGateway == "" {
+			return &InvalidConfigError{Field: "nym-gateway", Reason: "must be set to launch nym-client"}
+		}
+		if c.NymMaxRestarts < 0 {
+			return &InvalidConfigError{Field: "nym-max-restarts", Reason: "must not be negative"}
+		}
+	}
+	return nil
+}
+
+// NymPort is the port of NymURI, which nym-client is told to listen on when
+// we launch it
+func (c Config) NymPort() string {
+	u, err := url.Parse(c.NymURI)
+	if err != nil || u.Port() == "" {
+		return ""
+	}
+	return u.Port()
+}
+
+// Print writes the effective config, one option per line
+func (c Config) Print(w io.Writer) {
+	fmt.Fprintln(w, "effective configuration:")
+	for _, o := range c.options() {
+		fmt.Fprintf(w, "\t%-18s %s\n", o.flag, o.value())
+	}
+}
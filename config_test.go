@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// clearEnv unsets every ETERNITY_* variable for the test
+func clearEnv(t *testing.T) {
+	t.Helper()
+	var cfg Config
+	for _, o := range cfg.options() {
+		t.Setenv(o.env, "")
+		os.Unsetenv(o.env)
+	}
+	t.Setenv("ETERNITY_CONFIG", "")
+	os.Unsetenv("ETERNITY_CONFIG")
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want map[string]string
+	}{
+		{
+			name: "defaults",
+			want: map[string]string{"nym-uri": "ws://localhost:1977", "nym-id": "eternClient", "launch-nym-client": "false", "nym-max-restarts": "0"},
+		},
+		{
+			name: "file over defaults",
+			file: `{"nymid": "file", "nymuri": "ws://file:1977", "nymargs": ["--a", "--b"]}`,
+			want: map[string]string{"nym-id": "file", "nym-uri": "ws://file:1977", "nym-args": "--a --b", "nym-gateway": defaultConfig().NymGateway},
+		},
+		{
+			name: "environment over file",
+			file: `{"nymid": "file", "nymuri": "ws://file:1977", "nymmaxrestarts": 2}`,
+			env:  map[string]string{"ETERNITY_NYM_ID": "env", "ETERNITY_NYM_MAX_RESTARTS": "4", "ETERNITY_NYM_ARGS": "--x  --y"},
+			want: map[string]string{"nym-id": "env", "nym-uri": "ws://file:1977", "nym-max-restarts": "4", "nym-args": "--x --y"},
+		},
+		{
+			name: "flags over environment",
+			file: `{"nymid": "file", "launchnymclient": false}`,
+			env:  map[string]string{"ETERNITY_NYM_ID": "env", "ETERNITY_LAUNCH_NYM_CLIENT": "false"},
+			args: []string{"-nym-id", "flag", "-launch-nym-client"},
+			want: map[string]string{"nym-id": "flag", "launch-nym-client": "true"},
+		},
+		{
+			name: "flag set to the default over environment",
+			env:  map[string]string{"ETERNITY_NYM_ID": "env"},
+			args: []string{"-nym-id", "eternClient"},
+			want: map[string]string{"nym-id": "eternClient"},
+		},
+		{
+			name: "empty flag over environment",
+			env:  map[string]string{"ETERNITY_HTTP_LISTEN": "localhost:8080"},
+			args: []string{"-http-listen", ""},
+			want: map[string]string{"http-listen": ""},
+		},
+		{
+			name: "empty environment variable over file",
+			file: `{"httplisten": "localhost:8080"}`,
+			env:  map[string]string{"ETERNITY_HTTP_LISTEN": ""},
+			want: map[string]string{"http-listen": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			dir := t.TempDir()
+			args := append([]string{"-data-dir", dir}, tt.args...)
+			if tt.file != "" {
+				path := filepath.Join(dir, "eternity.json")
+				if err := ioutil.WriteFile(path, []byte(tt.file), 0644); err != nil {
+					t.Fatal(err)
+				}
+				args = append([]string{"-config", path}, args...)
+			}
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			cfg, err := loadConfig("serve", args)
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			got := make(map[string]string)
+			for _, o := range cfg.options() {
+				got[o.flag] = o.value()
+			}
+			for flag, want := range tt.want {
+				if got[flag] != want {
+					t.Errorf("%s = %q, want %q", flag, got[flag], want)
+				}
+			}
+			if cfg.DataDir != dir {
+				t.Errorf("data-dir = %q, want %q", cfg.DataDir, dir)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileFromEnvironment(t *testing.T) {
+	clearEnv(t)
+	dir := t.TempDir()
+	envFile := filepath.Join(dir, "env.json")
+	flagFile := filepath.Join(dir, "flag.json")
+	ioutil.WriteFile(envFile, []byte(`{"nymid": "env file"}`), 0644)
+	ioutil.WriteFile(flagFile, []byte(`{"nymid": "flag file"}`), 0644)
+	t.Setenv("ETERNITY_CONFIG", envFile)
+
+	cfg, err := loadConfig("serve", []string{"-data-dir", dir})
+	if err != nil || cfg.NymID != "env file" {
+		t.Fatalf("ETERNITY_CONFIG: nym-id %q, %v", cfg.NymID, err)
+	}
+	cfg, err = loadConfig("serve", []string{"-data-dir", dir, "-config", flagFile})
+	if err != nil || cfg.NymID != "flag file" {
+		t.Fatalf("-config over ETERNITY_CONFIG: nym-id %q, %v", cfg.NymID, err)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		env   map[string]string
+		args  []string
+		field string // of the InvalidConfigError, empty for any other error
+	}{
+		{name: "number from the environment", env: map[string]string{"ETERNITY_NYM_MAX_RESTARTS": "many"}, field: "nym-max-restarts"},
+		{name: "bool from the environment", env: map[string]string{"ETERNITY_LAUNCH_NYM_CLIENT": "maybe"}, field: "launch-nym-client"},
+		{name: "unknown flag", args: []string{"-nym-port", "1977"}},
+		{name: "extra arguments", args: []string{"now"}},
+		{name: "config file is not JSON", file: "nymid = file"},
+		{name: "missing config file", args: []string{"-config", "/nonexistent/eternity.json"}},
+		{name: "invalid after merging", env: map[string]string{"ETERNITY_NYM_URI": "http://localhost:1977"}, field: "nym-uri"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			dir := t.TempDir()
+			args := append([]string{"-data-dir", dir}, tt.args...)
+			if tt.file != "" {
+				path := filepath.Join(dir, "eternity.json")
+				if err := ioutil.WriteFile(path, []byte(tt.file), 0644); err != nil {
+					t.Fatal(err)
+				}
+				args = append([]string{"-config", path}, args...)
+			}
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			_, err := loadConfig("serve", args)
+			if err == nil {
+				t.Fatalf("loadConfig succeeded")
+			}
+			var configErr *InvalidConfigError
+			if tt.field != "" && (!errors.As(err, &configErr) || configErr.Field != tt.field) {
+				t.Fatalf("loadConfig: %v, want an InvalidConfigError for %s", err, tt.field)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(*Config)
+		field  string // empty when the config is valid
+	}{
+		{"defaults", func(*Config) {}, ""},
+		{"data dir not created yet", func(c *Config) { c.DataDir = filepath.Join(c.DataDir, "new") }, ""},
+		{"empty data dir", func(c *Config) { c.DataDir = "" }, "data-dir"},
+		{"data dir is a file", func(c *Config) { c.DataDir = file }, "data-dir"},
+		{"nym uri does not parse", func(c *Config) { c.NymURI = "ws://local host:%zz" }, "nym-uri"},
+		{"nym uri is not a websocket", func(c *Config) { c.NymURI = "http://localhost:1977" }, "nym-uri"},
+		{"nym uri without a host", func(c *Config) { c.NymURI = "ws://:1977" }, "nym-uri"},
+		{"secure nym uri", func(c *Config) { c.NymURI = "wss://nym.example" }, ""},
+		{"http listen without a port", func(c *Config) { c.HTTPListen = "localhost" }, "http-listen"},
+		{"http listen", func(c *Config) { c.HTTPListen = ":8080" }, ""},
+		{"launch without a binary", func(c *Config) { c.LaunchNymClient, c.NymBinary = true, "" }, "nym-binary"},
+		{"launch without an id", func(c *Config) { c.LaunchNymClient, c.NymID = true, "" }, "nym-id"},
+		{"launch without a gateway", func(c *Config) { c.LaunchNymClient, c.NymGateway = true, "" }, "nym-gateway"},
+		{"launch with negative restarts", func(c *Config) { c.LaunchNymClient, c.NymMaxRestarts = true, -1 }, "nym-max-restarts"},
+		{"negative restarts without launching", func(c *Config) { c.NymMaxRestarts = -1 }, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.DataDir = t.TempDir()
+			tt.change(&cfg)
+			err := cfg.validate()
+			if tt.field == "" {
+				if err != nil {
+					t.Fatalf("validate: %v", err)
+				}
+				if !filepath.IsAbs(cfg.DataDir) {
+					t.Fatalf("data-dir %q is not made absolute", cfg.DataDir)
+				}
+				return
+			}
+			var configErr *InvalidConfigError
+			if !errors.As(err, &configErr) || configErr.Field != tt.field {
+				t.Fatalf("validate: %v, want an InvalidConfigError for %s", err, tt.field)
+			}
+		})
+	}
+}
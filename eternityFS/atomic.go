@@ -0,0 +1,99 @@
+package eternityFS
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+/*****************
+
+Everything eternityFS keeps on disk is written so that a crash at any point
+leaves either the old or the new version behind, never half of one:
+
+1. the data goes to a temporary file in the same directory
+2. the temporary file is fsynced and closed
+3. it is renamed over the real name
+4. the directory is fsynced so the rename itself survives a power cut
+
+Stored files are listed in config.json before they are renamed into place
+and removed from disk before they leave it, so after a crash the index
+never lists a file we don't have the owner of. InitEFS removes the
+temporary files of writes that did not finish and drops index entries
+whose file is missing.
+
+*****************/
+
+// suffix of the temporary files written by writeFileAtomic
+const atomicTempSuffix = ".tmp-*"
+
+// crashHook is called between the steps of every write with the name of the
+// step just done, tests use it to stop a write where a crash could
+var crashHook func(step string)
+
+func crashPoint(step string) {
+	if crashHook != nil {
+		crashHook(step)
+	}
+}
+
+// syncDir fsyncs a directory so renames and removals in it are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncClose fsyncs and closes f, returning the first error
+func syncClose(f *os.File) error {
+	err := f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeFileAtomic replaces the file at path with data, readers and crashes
+// see either the old or the new contents
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+atomicTempSuffix)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	crashPoint("atomic write")
+	if syncErr := syncClose(tmp); err == nil {
+		err = syncErr
+	}
+	crashPoint("atomic fsync")
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	crashPoint("atomic rename")
+	err = syncDir(dir)
+	crashPoint("atomic dir sync")
+	return err
+}
+
+// removeAtomicTemps removes what is left of writeFileAtomic calls for path
+// that were cut short
+func removeAtomicTemps(path string) {
+	leftovers, _ := filepath.Glob(path + atomicTempSuffix)
+	for _, leftover := range leftovers {
+		os.Remove(leftover)
+	}
+}
@@ -0,0 +1,239 @@
+package eternityFS
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"eternity/eternityProto"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// crash is what crashHook panics with to stop a write
+type crash struct{}
+
+// crashSteps runs op once to list the steps it goes through
+func crashSteps(t *testing.T, op func() error) []string {
+	t.Helper()
+	var steps []string
+	crashHook = func(step string) { steps = append(steps, step) }
+	defer func() { crashHook = nil }()
+	if err := op(); err != nil {
+		t.Fatalf("op without a crash: %v", err)
+	}
+	return steps
+}
+
+// crashAfter runs op until it has done n steps and stops it there with a
+// panic. This checks the order of the steps only: deferred calls in op still
+// run, which crashExit avoids by exiting the process, and neither loses what
+// was written but not synced, that takes the machine going down.
+func crashAfter(n int, op func() error) {
+	done := 0
+	crashHook = func(string) {
+		done++
+		if done == n {
+			panic(crash{})
+		}
+	}
+	defer func() {
+		crashHook = nil
+		if r := recover(); r != nil {
+			if _, ok := r.(crash); !ok {
+				panic(r)
+			}
+		}
+	}()
+	op()
+}
+
+// checkRecovered opens dir again and checks the index and the files agree,
+// every file is listed with its owner and no temporary file is left
+func checkRecovered(t *testing.T, dir string, owner ed25519.PublicKey) EternityFS {
+	t.Helper()
+	efs, err := InitEFS(dir)
+	if err != nil {
+		t.Fatalf("InitEFS after the crash: %v", err)
+	}
+
+	if temps, _ := filepath.Glob(filepath.Join(dir, configFile) + atomicTempSuffix); len(temps) != 0 {
+		t.Errorf("config temporary files left: %v", temps)
+	}
+	items, err := ioutil.ReadDir(efs.Opts.FileDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onDisk := make(map[string]bool)
+	for _, item := range items {
+		if strings.HasPrefix(item.Name(), tempFilePrefix) {
+			t.Errorf("temporary file left: %s", item.Name())
+			continue
+		}
+		hash := hashFromFileName(item.Name())
+		onDisk[hash] = true
+		entry, ok := efs.FileMap[hash]
+		if !ok {
+			t.Errorf("%s is not in the index", hash)
+		} else if entry.PublicKey != base64.StdEncoding.EncodeToString(owner) {
+			t.Errorf("%s is indexed without its owner", hash)
+		}
+	}
+	for hash := range efs.FileMap {
+		if !onDisk[hash] {
+			t.Errorf("%s is in the index but not on disk", hash)
+		}
+	}
+	return efs
+}
+
+func TestCrashDuringStore(t *testing.T) {
+	pub, priv := testKey(t)
+	file := []byte("stored through a crash")
+	store := func(efs EternityFS) func() error {
+		return func() error {
+			_, err := efs.Store(file, pub, signFile(priv, file), false)
+			return err
+		}
+	}
+
+	steps := crashSteps(t, store(testEFS(t)))
+	for n, step := range steps {
+		t.Run(fmt.Sprintf("%d %s", n+1, step), func(t *testing.T) {
+			dir := t.TempDir()
+			efs, err := InitEFS(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			crashAfter(n+1, store(efs))
+
+			efs = checkRecovered(t, dir, pub)
+			// once the file is renamed into place the store survives
+			if step == "rename" || step == "dir sync" {
+				if got, err := efs.GetFile(sha256Base64(file)); err != nil || string(got) != string(file) {
+					t.Fatalf("file lost after the rename: %q, %v", got, err)
+				}
+			}
+			if _, err := efs.Store(file, pub, signFile(priv, file), false); err != nil {
+				t.Fatalf("Store after the crash: %v", err)
+			}
+			checkRecovered(t, dir, pub)
+		})
+	}
+}
+
+// set in the environment of the test binary when it is run to crash,
+// "<step>:<dir>"
+const crashExitEnv = "ETERNITY_TEST_CRASH_EXIT"
+
+// crashExitKey is the owner key of the crashExit stores, the same in every
+// process
+var crashExitKey = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+
+// crashExit stores a file in dir and exits the process after n steps, no
+// deferred call runs
+func crashExit(n int, dir string) {
+	efs, err := InitEFS(dir)
+	if err != nil {
+		os.Exit(1)
+	}
+	done := 0
+	crashHook = func(string) {
+		done++
+		if done == n {
+			os.Exit(3)
+		}
+	}
+	file := []byte("stored through a crash")
+	efs.Store(file, crashExitKey.Public().(ed25519.PublicKey), signFile(crashExitKey, file), false)
+	os.Exit(0)
+}
+
+func TestCrashExitDuringStore(t *testing.T) {
+	if spec := os.Getenv(crashExitEnv); spec != "" {
+		parts := strings.SplitN(spec, ":", 2)
+		n, _ := strconv.Atoi(parts[0])
+		crashExit(n, parts[1])
+	}
+
+	pub := crashExitKey.Public().(ed25519.PublicKey)
+	file := []byte("stored through a crash")
+	efs := testEFS(t)
+	steps := crashSteps(t, func() error {
+		_, err := efs.Store(file, pub, signFile(crashExitKey, file), false)
+		return err
+	})
+	for n, step := range steps {
+		t.Run(fmt.Sprintf("%d %s", n+1, step), func(t *testing.T) {
+			dir := t.TempDir()
+			cmd := exec.Command(os.Args[0], "-test.run=^TestCrashExitDuringStore$")
+			cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d:%s", crashExitEnv, n+1, dir))
+			var exitErr *exec.ExitError
+			if err := cmd.Run(); !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+				t.Fatalf("store did not crash at %s: %v", step, err)
+			}
+
+			efs := checkRecovered(t, dir, pub)
+			if step == "rename" || step == "dir sync" {
+				if got, err := efs.GetFile(sha256Base64(file)); err != nil || string(got) != string(file) {
+					t.Fatalf("file lost after the rename: %q, %v", got, err)
+				}
+			}
+			if _, err := efs.Store(file, pub, signFile(crashExitKey, file), false); err != nil {
+				t.Fatalf("Store after the crash: %v", err)
+			}
+			checkRecovered(t, dir, pub)
+		})
+	}
+}
+
+func TestCrashDuringDelete(t *testing.T) {
+	pub, priv := testKey(t)
+	file := []byte("deleted through a crash")
+	hash := sha256Base64(file)
+	rawHash, _ := base64.StdEncoding.DecodeString(hash)
+	stored := func(t *testing.T) (string, EternityFS) {
+		dir := t.TempDir()
+		efs, err := InitEFS(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := efs.Store(file, pub, signFile(priv, file), false); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		return dir, efs
+	}
+	del := func(efs EternityFS) func() error {
+		return func() error {
+			signed := time.Now()
+			return efs.Delete(hash, ed25519.Sign(priv, eternityProto.DeleteSignatureData(rawHash, signed)), signed)
+		}
+	}
+
+	_, efs := stored(t)
+	steps := crashSteps(t, del(efs))
+	for n, step := range steps {
+		t.Run(fmt.Sprintf("%d %s", n+1, step), func(t *testing.T) {
+			dir, efs := stored(t)
+			crashAfter(n+1, del(efs))
+
+			efs = checkRecovered(t, dir, pub)
+			// once the file is removed the delete survives
+			if efs.Search(hash) {
+				t.Fatalf("file still stored after a crash at %s", step)
+			}
+		})
+	}
+}
+
+func sha256Base64(file []byte) string {
+	hash := sha256.Sum256(file)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
@@ -2,14 +2,21 @@ package eternityFS
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"eternity/eternityProto"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 type HashTable struct{}
@@ -21,85 +28,187 @@ type FileIndexEntry struct {
 	// these are used to validate delete options
 	PublicKey string `json:"pubkey"`    // base64 encoded []byte
 	Signature string `json:"signature"` // base64 encoded []byte
+
+	// private files are only found and served for their owner
+	Private bool `json:"private"`
+
+	// unix seconds the file was last stored at, deletes signed before
+	// then are refused
+	Stored int64 `json:"stored"`
 }
 
 type efsOpts struct {
-	Dir     string   `json:"path"`
-	FileDir string   `json:"filepath"`
-	Peers   []string `json:"peers"`
+	Dir        string   `json:"path"`
+	FileDir    string   `json:"filepath"`
+	StagingDir string   `json:"stagingpath"` // chunks of uploads in progress
+	Peers      []string `json:"peers"`
+	NymAddress string   `json:"nymaddress"` // where users reach this server
+
+	// seconds an upload may go without a new chunk before it is removed
+	StagingTimeout int64 `json:"stagingtimeout"`
 }
 
 type EternityFS struct {
 	Opts    efsOpts                   `json:"opts"`
 	FileMap map[string]FileIndexEntry `json:"filemap"`
+
+	mut        *sync.RWMutex // guards FileMap, manifests and nymAddress, shared between copies of the EternityFS
+	uploads    *uploadTable  // chunked uploads in progress
+	nymAddress *string       // the live Opts.NymAddress
+
+	// manifests of the stored files by hash, built when a file is stored
+	// or indexed so serving a manifest does not hash the file again
+	manifests map[string]eternityProto.Manifest
 }
 
-func makeConfig(dir string) EternityFS {
-	fmt.Println(dir)
+const configFile = "config.json"
+
+type CorruptConfigError struct {
+	Path string
+	Err  error
+}
+
+func (e *CorruptConfigError) Error() string {
+	return fmt.Sprintf("eternityFS config %s can not be read, move it away to start over: %v", e.Path, e.Err)
+}
+
+func makeConfig(dir string) (EternityFS, error) {
+	log.Printf("creating a new eternityFS in %s", dir)
 	defaultOpts := &efsOpts{
-		Dir:     dir,
-		FileDir: dir + "/files",
-		Peers:   make([]string, 0),
+		Dir:            dir,
+		FileDir:        dir + "/files",
+		StagingDir:     dir + "/staging",
+		Peers:          make([]string, 0),
+		StagingTimeout: DefaultStagingTimeout,
 	}
 	defaultConfig := &EternityFS{
-		Opts:    *defaultOpts,
-		FileMap: make(map[string]FileIndexEntry),
+		Opts:       *defaultOpts,
+		FileMap:    make(map[string]FileIndexEntry),
+		mut:        &sync.RWMutex{},
+		uploads:    newUploadTable(),
+		nymAddress: new(string),
+		manifests:  make(map[string]eternityProto.Manifest),
 	}
-	file, err := json.Marshal(defaultConfig)
-	if err != nil {
-		panic(err)
+	if err := defaultConfig.saveConfig(); err != nil {
+		return EternityFS{}, err
 	}
-
-	ioutil.WriteFile(dir+"/config.json", file, os.ModePerm)
-	return *defaultConfig
+	return *defaultConfig, nil
 }
-func InitEFS(dir string) (EternityFS, error) {
-	dirExists := false
-	fileDir := dir + "/files"
-	// check if the directory exists
-	if _, err := os.Stat(dir); !os.IsNotExist(err) {
-		dirExists = true
-	}
-
-	// if no directory exists, create it and populate the config and filepath
-	if !dirExists {
-		os.Mkdir(dir, 0777)
-		os.Mkdir(dir+"/files", os.ModePerm)
-
-		defaultConfig := makeConfig(dir)
-		return defaultConfig, nil
-	} else {
-		// load config if it does exist
-		efs := EternityFS{}
-		configFile := make([]byte, 0)
-		if _, err := os.Stat(dir + "/config.json"); errors.Is(err, os.ErrNotExist) {
-			efs = makeConfig(dir)
-		} else {
-			configFile, err = ioutil.ReadFile(dir + "/config.json")
-			if err != nil {
-				return EternityFS{}, err
-			}
 
+// InitEFS opens the eternityFS in dir, creating it if needed. Whatever a
+// crash left behind is cleaned up first: temporary files are removed and
+// files in the index that never made it to disk are dropped from it.
+func InitEFS(dir string) (EternityFS, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return EternityFS{}, err
+	}
+	configPath := dir + "/" + configFile
+	removeAtomicTemps(configPath)
+
+	efs := EternityFS{}
+	raw, err := ioutil.ReadFile(configPath)
+	if errors.Is(err, os.ErrNotExist) {
+		if efs, err = makeConfig(dir); err != nil {
+			return EternityFS{}, err
 		}
+	} else if err != nil {
+		return EternityFS{}, err
+	} else if err := json.Unmarshal(raw, &efs); err != nil {
+		return EternityFS{}, &CorruptConfigError{Path: configPath, Err: err}
+	}
 
-		json.Unmarshal(configFile, &efs)
-		configFilePath := efs.Opts.FileDir
-		if _, err := os.Stat(configFilePath); !os.IsNotExist(err) {
-			os.Mkdir(fileDir, 0664)
-		}
-		efs.IndexFiles(fileDir)
-		return efs, nil
+	if efs.FileMap == nil {
+		efs.FileMap = make(map[string]FileIndexEntry)
+	}
+	efs.mut = &sync.RWMutex{}
+	efs.uploads = newUploadTable()
+	efs.manifests = make(map[string]eternityProto.Manifest)
+	nymAddress := efs.Opts.NymAddress
+	efs.nymAddress = &nymAddress
+	if efs.Opts.Dir == "" {
+		efs.Opts.Dir = dir
+	}
+	if efs.Opts.FileDir == "" {
+		efs.Opts.FileDir = dir + "/files"
+	}
+	if efs.Opts.StagingDir == "" {
+		efs.Opts.StagingDir = dir + "/staging"
+	}
+	if efs.Opts.StagingTimeout == 0 {
+		efs.Opts.StagingTimeout = DefaultStagingTimeout
 	}
+
+	if err := os.MkdirAll(efs.Opts.FileDir, 0755); err != nil {
+		return EternityFS{}, err
+	}
+	if err := efs.loadStaging(); err != nil {
+		return EternityFS{}, err
+	}
+	efs.CollectUploads()
+	if err := efs.IndexFiles(efs.Opts.FileDir); err != nil {
+		return EternityFS{}, err
+	}
+	return efs, nil
 }
 
 func (efs EternityFS) SaveConfig() error {
+	efs.mut.RLock()
+	defer efs.mut.RUnlock()
+	return efs.saveConfig()
+}
+
+// saveConfig writes the config, the caller must hold the lock
+func (efs EternityFS) saveConfig() error {
+	efs.Opts.NymAddress = *efs.nymAddress
 	file, err := json.Marshal(efs)
 	if err != nil {
 		return err
 	}
-	os.Remove(efs.Opts.Dir + "/config.json")
-	ioutil.WriteFile(efs.Opts.Dir+"/config.json", file, os.ModePerm)
-	return nil
+	return writeFileAtomic(efs.Opts.Dir+"/"+configFile, file, 0644)
+}
+
+// NymAddress is the nym address the server was last seen at
+func (efs EternityFS) NymAddress() string {
+	efs.mut.RLock()
+	defer efs.mut.RUnlock()
+	return *efs.nymAddress
+}
+
+// SetNymAddress saves the nym address of the server in the config
+func (efs EternityFS) SetNymAddress(address string) error {
+	efs.mut.Lock()
+	defer efs.mut.Unlock()
+	if *efs.nymAddress == address {
+		return nil
+	}
+	*efs.nymAddress = address
+	return efs.saveConfig()
+}
+
+type NoNymAddressError struct{}
+
+func (e *NoNymAddressError) Error() string {
+	return "no nym address saved yet, run the server once to learn it"
+}
+
+// StoredNymAddress reads the nym address saved in the config in dir
+// without loading the rest of the eternityFS
+func StoredNymAddress(dir string) (string, error) {
+	configPath := dir + "/" + configFile
+	raw, err := ioutil.ReadFile(configPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", &NoNymAddressError{}
+	} else if err != nil {
+		return "", err
+	}
+	efs := EternityFS{}
+	if err := json.Unmarshal(raw, &efs); err != nil {
+		return "", &CorruptConfigError{Path: configPath, Err: err}
+	}
+	if efs.Opts.NymAddress == "" {
+		return "", &NoNymAddressError{}
+	}
+	return efs.Opts.NymAddress, nil
 }
 
 type FileNotFoundError struct{}
@@ -108,136 +217,421 @@ func (e *FileNotFoundError) Error() string {
 	return "file with that hash not found"
 }
 
-func (efs EternityFS) GetFile(hash string) ([]byte, error) {
+type NoOwnerKeyError struct{}
+
+func (e *NoOwnerKeyError) Error() string {
+	return "file has no owner key, it can not be deleted"
+}
+
+type FileOwnedError struct{}
+
+func (e *FileOwnedError) Error() string {
+	return "file is already stored under another key"
+}
+
+// Open opens a stored file for reading, the caller closes it. The file stays
+// readable through the handle even if it is deleted meanwhile.
+func (efs EternityFS) Open(hash string) (io.ReadSeekCloser, error) {
+	efs.mut.RLock()
 	fileIndex, ok := efs.FileMap[hash]
+	efs.mut.RUnlock()
 	if !ok {
-		// file does not exist
-		return make([]byte, 0), &FileNotFoundError{}
+		return nil, &FileNotFoundError{}
+	}
+	file, err := os.Open(fileIndex.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		// deleted after we looked it up
+		return nil, &FileNotFoundError{}
+	} else if err != nil {
+		return nil, err
 	}
-	filepath := fileIndex.Path
-	file, err := ioutil.ReadFile(filepath)
+	return file, nil
+}
+
+// GetFile reads a whole stored file into memory, use Open for large files
+func (efs EternityFS) GetFile(hash string) ([]byte, error) {
+	file, err := efs.Open(hash)
 	if err != nil {
 		return make([]byte, 0), err
 	}
-	return file, nil
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+type FileTooLargeError struct {
+	Size  int64
+	Limit int64
+}
+
+func (e *FileTooLargeError) Error() string {
+	return fmt.Sprintf("file is %d bytes, more than the %d served whole, fetch it by manifest and chunks", e.Size, e.Limit)
+}
+
+// GetFileUpTo is GetFile for files of at most limit bytes, bigger files are
+// refused with FileTooLargeError before anything is read
+func (efs EternityFS) GetFileUpTo(hash string, limit int64) ([]byte, error) {
+	file, err := efs.Open(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if size > limit {
+		return nil, &FileTooLargeError{Size: size, Limit: limit}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(io.LimitReader(file, limit))
 }
 
 func (efs EternityFS) Search(hash string) bool {
+	efs.mut.RLock()
+	defer efs.mut.RUnlock()
 	if _, ok := efs.FileMap[hash]; ok {
 		return true
 	}
 	return false
 }
 
-func (efs EternityFS) Store(file []byte, publicKey []byte, sig []byte) (string, error) {
-	r := bytes.NewReader(file)
-	h := sha256.New()
+type InvalidPublicKeyError struct{}
+
+func (e *InvalidPublicKeyError) Error() string {
+	return "public key is not a valid ED25519 key"
+}
 
-	if _, err := io.Copy(h, r); err != nil {
+type InvalidSignatureError struct{}
+
+func (e *InvalidSignatureError) Error() string {
+	return "file signature does not verify against public key"
+}
+
+// VerifyFileSignature checks that sig is an ED25519 signature by publicKey
+// over the SHA-256 hash of the file body.
+func VerifyFileSignature(file []byte, publicKey []byte, sig []byte) error {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return &InvalidPublicKeyError{}
+	}
+	if len(sig) != ed25519.SignatureSize {
+		return &InvalidSignatureError{}
+	}
+
+	fileHash := sha256.Sum256(file)
+	if ed25519.Verify(ed25519.PublicKey(publicKey), fileHash[:], sig) {
+		return nil
+	}
+	return &InvalidSignatureError{}
+}
+
+// hashes are base64 encoded, so swap the characters that are not safe in a
+// file name for their url safe equivalents
+var fileNameReplacer = strings.NewReplacer("/", "_", "+", "-")
+var hashNameReplacer = strings.NewReplacer("_", "/", "-", "+")
+
+func fileName(hash string) string {
+	return fileNameReplacer.Replace(hash)
+}
+
+func hashFromFileName(name string) string {
+	return hashNameReplacer.Replace(name)
+}
+
+// Store verifies the signature of the file and writes it to the file
+// directory, nothing is written if the signature does not verify. A file
+// that is already stored under another key is refused with FileOwnedError,
+// its owner may store it again to change its visibility.
+func (efs EternityFS) Store(file []byte, publicKey []byte, sig []byte, private bool) (string, error) {
+	if err := VerifyFileSignature(file, publicKey, sig); err != nil {
+		return "", err
+	}
+	tmpPath, m, err := efs.writeTemp(bytes.NewReader(file))
+	if err != nil {
 		return "", err
 	}
+	return efs.commit(tmpPath, m, publicKey, sig, private)
+}
 
-	fileHash := base64.StdEncoding.EncodeToString(h.Sum(nil))
-	filepath := efs.Opts.Dir + "/" + string(fileHash)
-	println("storing file with hash: ", string(fileHash), " at ", efs.Opts.FileDir+"/"+string(fileHash))
-	err := ioutil.WriteFile(efs.Opts.FileDir+"/"+string(fileHash), file, os.ModePerm)
+// Put is Store for a file read from r, which is never held in memory. It is
+// hashed while it is written to a temporary file, which is renamed into place
+// once sig verifies as an ED25519 signature of the SHA-256 hash.
+func (efs EternityFS) Put(r io.Reader, publicKey []byte, sig []byte, private bool) (string, error) {
+	tmpPath, m, err := efs.writeTemp(r)
 	if err != nil {
 		return "", err
 	}
-	efs.FileMap[string(fileHash)] = FileIndexEntry{
-		Path:      filepath,
+	if err := verifyHashSignature(m.FileHash, publicKey, sig); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return efs.commit(tmpPath, m, publicKey, sig, private)
+}
+
+// temporary files are written next to the stored files so they can be
+// renamed into place, IndexFiles removes any left behind
+const tempFilePrefix = ".put-"
+
+// writeTemp copies r to a temporary file in the file directory and returns
+// its path and the manifest of what was written, which holds its SHA-256
+// hash
+func (efs EternityFS) writeTemp(r io.Reader) (string, eternityProto.Manifest, error) {
+	tmp, err := ioutil.TempFile(efs.Opts.FileDir, tempFilePrefix+"*")
+	if err != nil {
+		return "", eternityProto.Manifest{}, err
+	}
+	m, err := eternityProto.ManifestFromReader(io.TeeReader(r, tmp), eternityProto.DefaultChunkSize)
+	crashPoint("temp write")
+	if syncErr := syncClose(tmp); err == nil {
+		err = syncErr
+	}
+	crashPoint("temp fsync")
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", eternityProto.Manifest{}, err
+	}
+	return tmp.Name(), m, nil
+}
+
+// commit moves a file written by writeTemp into place under its hash and
+// adds it to the index. The index is saved first, a crash before the rename
+// leaves an entry without a file, which InitEFS drops.
+func (efs EternityFS) commit(tmpPath string, m eternityProto.Manifest, publicKey []byte, sig []byte, private bool) (string, error) {
+	fileHash := base64.StdEncoding.EncodeToString(m.FileHash)
+	path := efs.Opts.FileDir + "/" + fileName(fileHash)
+	efs.mut.Lock()
+	defer efs.mut.Unlock()
+	owner := base64.StdEncoding.EncodeToString(publicKey)
+	previous, stored := efs.FileMap[fileHash]
+	if stored && previous.PublicKey != "" && previous.PublicKey != owner {
+		os.Remove(tmpPath)
+		return "", &FileOwnedError{}
+	}
+
+	efs.FileMap[fileHash] = FileIndexEntry{
+		Path:      path,
 		Hash:      fileHash,
-		PublicKey: base64.StdEncoding.EncodeToString(publicKey),
+		PublicKey: owner,
 		Signature: base64.StdEncoding.EncodeToString(sig),
+		Private:   private,
+		Stored:    time.Now().Unix(),
 	}
-
-	efs.SaveConfig()
+	err := efs.saveConfig()
+	crashPoint("config save")
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+		crashPoint("rename")
+	}
+	if err == nil {
+		err = syncDir(efs.Opts.FileDir)
+		crashPoint("dir sync")
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		if stored {
+			efs.FileMap[fileHash] = previous
+		} else {
+			delete(efs.FileMap, fileHash)
+		}
+		efs.saveConfig()
+		return "", err
+	}
+	efs.manifests[fileHash] = m
+	log.Printf("stored %s at %s", fileHash, path)
 
 	return fileHash, nil
 }
 
-func checkFileHash(hash string, path string) (bool, error) {
-	file, err := ioutil.ReadFile(path)
+// Authorize checks that a file may be found and served for a request, sig
+// is the signature of eternityProto.ReadSignatureData that has to come with
+// requests for private files. Private files the signature does not unlock
+// are not found.
+func (efs EternityFS) Authorize(hash string, sig []byte) error {
+	efs.mut.RLock()
+	entry, ok := efs.FileMap[hash]
+	efs.mut.RUnlock()
+	if !ok {
+		return &FileNotFoundError{}
+	}
+	if !entry.Private {
+		return nil
+	}
+
+	publicKey, err := base64.StdEncoding.DecodeString(entry.PublicKey)
+	if err != nil {
+		return &FileNotFoundError{}
+	}
+	rawHash, err := base64.StdEncoding.DecodeString(hash)
 	if err != nil {
-		return false, err
+		return &FileNotFoundError{}
 	}
+	if verifyHashSignature(eternityProto.ReadSignatureData(rawHash), publicKey, sig) != nil {
+		return &FileNotFoundError{}
+	}
+	return nil
+}
+
+// DeleteClockSkew is how far ahead of our clock a delete may be signed
+const DeleteClockSkew = 10 * time.Minute
+
+type StaleDeleteError struct {
+	Signed time.Time
+	Stored time.Time
+}
+
+func (e *StaleDeleteError) Error() string {
+	if e.Signed.Before(e.Stored) {
+		return fmt.Sprintf("delete signed at %s, before the file was stored at %s", e.Signed.UTC(), e.Stored.UTC())
+	}
+	return fmt.Sprintf("delete signed at %s, too far in the future", e.Signed.UTC())
+}
 
-	r := bytes.NewReader(file)
-	h := sha256.New()
+// Delete removes the file with the given hash, sig must be an ED25519
+// signature of eternityProto.DeleteSignatureData(hash, signed) by the public
+// key saved with the file. The delete must be signed after the file was
+// stored, so it can't be replayed once the file is stored again.
+func (efs EternityFS) Delete(hash string, sig []byte, signed time.Time) error {
+	efs.mut.Lock()
+	defer efs.mut.Unlock()
 
-	if _, err := io.Copy(h, r); err != nil {
-		return false, err
+	entry, ok := efs.FileMap[hash]
+	if !ok {
+		return &FileNotFoundError{}
 	}
-	tempHash := base64.StdEncoding.EncodeToString(h.Sum(nil))
-	if hash != tempHash {
-		return false, nil
+	if entry.PublicKey == "" {
+		return &NoOwnerKeyError{}
 	}
 
-	return true, nil
+	publicKey, err := base64.StdEncoding.DecodeString(entry.PublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return &NoOwnerKeyError{}
+	}
+	rawHash, err := base64.StdEncoding.DecodeString(hash)
+	if err != nil {
+		return &FileNotFoundError{}
+	}
+	signData := eternityProto.DeleteSignatureData(rawHash, signed)
+	if len(sig) != ed25519.SignatureSize || !ed25519.Verify(ed25519.PublicKey(publicKey), signData, sig) {
+		return &InvalidSignatureError{}
+	}
+	stored := time.Unix(entry.Stored, 0)
+	if signed.Before(stored) || signed.After(time.Now().Add(DeleteClockSkew)) {
+		return &StaleDeleteError{Signed: signed, Stored: stored}
+	}
+
+	// the file goes before its entry, a file without an entry would come
+	// back as a public file nobody owns
+	if err := os.Remove(entry.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	crashPoint("remove")
+	if err := syncDir(filepath.Dir(entry.Path)); err != nil {
+		return err
+	}
+	crashPoint("dir sync")
+	delete(efs.FileMap, hash)
+	delete(efs.manifests, hash)
+	log.Printf("deleted %s from %s", hash, entry.Path)
+
+	return efs.saveConfig()
 }
 
-func (efs EternityFS) IndexFiles(dir string) error {
-	// look for a hashfile
+// checkFileHash builds the manifest of the file at path and checks it
+// matches hash
+func checkFileHash(hash string, path string) (eternityProto.Manifest, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return eternityProto.Manifest{}, false, err
+	}
+	defer file.Close()
+
+	m, err := eternityProto.ManifestFromReader(file, eternityProto.DefaultChunkSize)
+	if err != nil {
+		return eternityProto.Manifest{}, false, err
+	}
+	if hash != base64.StdEncoding.EncodeToString(m.FileHash) {
+		return eternityProto.Manifest{}, false, nil
+	}
 
+	return m, true, nil
+}
+
+// IndexFiles checks the index against the files in dir. Entries whose file
+// is missing or does not match its hash are dropped, along with the file,
+// and files that are not in the index are added to it without an owner.
+func (efs EternityFS) IndexFiles(dir string) error {
 	items, err := ioutil.ReadDir(dir)
 	if err != nil {
 		return err
 	}
 
+	efs.mut.Lock()
+	defer efs.mut.Unlock()
+	changed := false
+
 	for hash, entry := range efs.FileMap {
 		path := entry.Path
 		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			// stored or deleted when we went down
 			delete(efs.FileMap, hash)
-		} else {
-			val, err := checkFileHash(hash, path)
-			if err != nil {
-				return err
-			}
-
-			if !val {
-				delete(efs.FileMap, hash)
-				os.Remove(path)
-				efs.SaveConfig()
-			}
-
+			delete(efs.manifests, hash)
+			changed = true
+			continue
 		}
+		m, val, err := checkFileHash(hash, path)
 		if err != nil {
 			return err
 		}
+		if !val {
+			delete(efs.FileMap, hash)
+			delete(efs.manifests, hash)
+			os.Remove(path)
+			changed = true
+			continue
+		}
+		efs.manifests[hash] = m
 	}
+
 	for _, item := range items {
 		if item.IsDir() {
 			continue
-		} else {
-			path := dir + "/" + item.Name()
-			println("file path: ", path)
+		}
+		path := dir + "/" + item.Name()
+		if strings.HasPrefix(item.Name(), tempFilePrefix) {
+			// a store that never finished
+			os.Remove(path)
+			continue
+		}
 
-			val, err := checkFileHash(item.Name(), path)
+		hash := hashFromFileName(item.Name())
+		m, val, err := checkFileHash(hash, path)
+		if err != nil {
+			return err
+		}
 
-			if err != nil {
-				return err
+		if !val {
+			// hashes do not match
+			os.Remove(path)
+			if _, ok := efs.FileMap[hash]; ok {
+				delete(efs.FileMap, hash)
+				delete(efs.manifests, hash)
+				changed = true
 			}
-
-			if !val {
-				// hashes do not match
-				os.Remove(path)
-
-				// remove from file hash
-				delete(efs.FileMap, item.Name())
-				efs.SaveConfig()
-			} else {
-				println("hash matches file")
-				// add file to hash map if its name and hash match
-				if _, ok := efs.FileMap[item.Name()]; !ok {
-					efs.FileMap[item.Name()] = FileIndexEntry{
-						Path: path,
-						Hash: item.Name(),
-					}
-					efs.SaveConfig()
-				}
+		} else if _, ok := efs.FileMap[hash]; !ok {
+			// add file to hash map if its name and hash match
+			log.Printf("indexing %s without an owner", path)
+			efs.FileMap[hash] = FileIndexEntry{
+				Path: path,
+				Hash: hash,
 			}
+			efs.manifests[hash] = m
+			changed = true
 		}
 	}
 
-	return nil
+	if !changed {
+		return nil
+	}
+	return efs.saveConfig()
 }
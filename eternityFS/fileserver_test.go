@@ -0,0 +1,206 @@
+package eternityFS
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"eternity/eternityProto"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestStoreByAnotherKey(t *testing.T) {
+	efs := testEFS(t)
+	pub, priv := testKey(t)
+	otherPub, otherPriv := testKey(t)
+
+	file := []byte("mine")
+	hash, err := efs.Store(file, pub, signFile(priv, file), false)
+	if err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	var ownedErr *FileOwnedError
+	if _, err := efs.Store(file, otherPub, signFile(otherPriv, file), true); !errors.As(err, &ownedErr) {
+		t.Fatalf("Store by another key: %v, want FileOwnedError", err)
+	}
+	m := eternityProto.NewManifest(file, eternityProto.DefaultChunkSize)
+	if _, err := efs.BeginUpload(m, otherPub, ed25519.Sign(otherPriv, m.FileHash), true); !errors.As(err, &ownedErr) {
+		t.Fatalf("BeginUpload by another key: %v, want FileOwnedError", err)
+	}
+
+	entry := efs.FileMap[hash]
+	if entry.Private || efs.Authorize(hash, nil) != nil {
+		t.Fatalf("another key changed the visibility of the file")
+	}
+	if _, err := efs.Store(file, pub, signFile(priv, file), false); err != nil {
+		t.Fatalf("Store again by the owner: %v", err)
+	}
+	fileHash := sha256.Sum256(file)
+	if missing, err := efs.BeginUpload(m, pub, ed25519.Sign(priv, fileHash[:]), false); err != nil || len(missing) != 0 {
+		t.Fatalf("BeginUpload by the owner: %v, %v", missing, err)
+	}
+}
+
+func TestStoreRejectsBadSignatures(t *testing.T) {
+	pub, priv := testKey(t)
+	otherPub, otherPriv := testKey(t)
+	file := []byte("signed over its hash")
+	corrupt := signFile(priv, file)
+	corrupt[0] ^= 0xff
+
+	cases := []struct {
+		name string
+		pub  []byte
+		sig  []byte
+		err  error
+	}{
+		{"signature over the body", pub, ed25519.Sign(priv, file), &InvalidSignatureError{}},
+		{"corrupt signature", pub, corrupt, &InvalidSignatureError{}},
+		{"short signature", pub, signFile(priv, file)[:32], &InvalidSignatureError{}},
+		{"another key", otherPub, signFile(priv, file), &InvalidSignatureError{}},
+		{"signed by another key", pub, signFile(otherPriv, file), &InvalidSignatureError{}},
+		{"malformed key", pub[:16], signFile(priv, file), &InvalidPublicKeyError{}},
+		{"no key", nil, signFile(priv, file), &InvalidPublicKeyError{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			efs := testEFS(t)
+			configPath := efs.Opts.Dir + "/" + configFile
+			before, err := ioutil.ReadFile(configPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = efs.Store(file, c.pub, c.sig, false)
+			switch c.err.(type) {
+			case *InvalidSignatureError:
+				var sigErr *InvalidSignatureError
+				if !errors.As(err, &sigErr) {
+					t.Fatalf("Store: %v, want InvalidSignatureError", err)
+				}
+			case *InvalidPublicKeyError:
+				var keyErr *InvalidPublicKeyError
+				if !errors.As(err, &keyErr) {
+					t.Fatalf("Store: %v, want InvalidPublicKeyError", err)
+				}
+			}
+
+			if items, err := ioutil.ReadDir(efs.Opts.FileDir); err != nil || len(items) != 0 {
+				t.Fatalf("files written after a refused store: %v, %v", items, err)
+			}
+			after, err := ioutil.ReadFile(configPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(after) != string(before) {
+				t.Fatalf("config.json changed after a refused store")
+			}
+			if len(efs.FileMap) != 0 {
+				t.Fatalf("file indexed after a refused store: %v", efs.FileMap)
+			}
+		})
+	}
+}
+
+func signFile(priv ed25519.PrivateKey, file []byte) []byte {
+	hash := sha256.Sum256(file)
+	return ed25519.Sign(priv, hash[:])
+}
+
+func TestPutServedInChunks(t *testing.T) {
+	dir := t.TempDir()
+	efs, err := InitEFS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, priv := testKey(t)
+	file := make([]byte, 3*eternityProto.DefaultChunkSize+100)
+	rand.New(rand.NewSource(5)).Read(file)
+	want := eternityProto.NewManifest(file, eternityProto.DefaultChunkSize)
+
+	hash, err := efs.Put(bytes.NewReader(file), pub, signFile(priv, file), false)
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	opened, err := efs.Open(hash)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	got, err := ioutil.ReadAll(opened)
+	opened.Close()
+	if err != nil || !bytes.Equal(got, file) {
+		t.Fatalf("Open read %d bytes, want the %d put: %v", len(got), len(file), err)
+	}
+
+	// the manifest is built while the file is put, changing the file on
+	// disk afterwards does not change what is served
+	m, err := efs.Manifest(hash)
+	if err != nil || !bytes.Equal(m.Encode(), want.Encode()) {
+		t.Fatalf("Manifest: %v, does not match the file", err)
+	}
+	if err := ioutil.WriteFile(efs.FileMap[hash].Path, bytes.Repeat([]byte{0}, len(file)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := efs.Manifest(hash); err != nil || !bytes.Equal(m.Encode(), want.Encode()) {
+		t.Fatalf("Manifest built again from the file on disk: %v", err)
+	}
+	if err := ioutil.WriteFile(efs.FileMap[hash].Path, file, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// and when the file is indexed again
+	efs, err = InitEFS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = efs.Manifest(hash)
+	if err != nil || !bytes.Equal(m.Encode(), want.Encode()) {
+		t.Fatalf("Manifest after InitEFS: %v, does not match the file", err)
+	}
+	var served []byte
+	for index := uint32(0); index < m.ChunkCount(); index++ {
+		chunk, err := efs.GetChunk(hash, index)
+		if err != nil {
+			t.Fatalf("GetChunk %d: %v", index, err)
+		}
+		if err := m.VerifyChunk(index, chunk); err != nil {
+			t.Fatalf("GetChunk %d: %v", index, err)
+		}
+		served = append(served, chunk...)
+	}
+	if !bytes.Equal(served, file) {
+		t.Fatalf("chunks served do not make up the file")
+	}
+
+	var tooLargeErr *FileTooLargeError
+	if _, err := efs.GetFileUpTo(hash, int64(len(file)-1)); !errors.As(err, &tooLargeErr) {
+		t.Fatalf("GetFileUpTo under the file size: %v, want FileTooLargeError", err)
+	}
+	if got, err := efs.GetFileUpTo(hash, int64(len(file))); err != nil || !bytes.Equal(got, file) {
+		t.Fatalf("GetFileUpTo the file size: %d bytes, %v", len(got), err)
+	}
+}
+
+func TestManifestDeleted(t *testing.T) {
+	efs := testEFS(t)
+	pub, priv := testKey(t)
+	file := []byte("gone soon")
+	hash, err := efs.Store(file, pub, signFile(priv, file), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawHash, _ := base64.StdEncoding.DecodeString(hash)
+	signed := time.Now()
+	if err := efs.Delete(hash, ed25519.Sign(priv, eternityProto.DeleteSignatureData(rawHash, signed)), signed); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	var notFoundErr *FileNotFoundError
+	if _, err := efs.Manifest(hash); !errors.As(err, &notFoundErr) {
+		t.Fatalf("Manifest of a deleted file: %v, want FileNotFoundError", err)
+	}
+}
@@ -0,0 +1,547 @@
+package eternityFS
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"eternity/eternityProto"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultStagingTimeout is how long an upload may go without receiving a
+// chunk before it is garbage collected
+const DefaultStagingTimeout = 24 * 60 * 60 // seconds
+
+const uploadStateFile = "state.json"
+
+// upload is a chunked upload in progress, chunks are kept in the staging
+// directory until every chunk has arrived. The state is saved next to the
+// chunks so uploads survive a restart.
+type upload struct {
+	Manifest  eternityProto.Manifest
+	PublicKey []byte
+	Signature []byte
+	Private   bool
+	received  []byte // bitmap of the chunks we have
+	updated   time.Time
+	dir       string
+
+	// closed once the complete upload has been stored, or failed to be,
+	// nil while chunks are missing
+	finishing chan struct{}
+}
+
+// uploadState is what we save of an upload in its staging directory
+type uploadState struct {
+	Manifest  []byte    `json:"manifest"` // encoded manifest, holds the expected hash
+	PublicKey []byte    `json:"pubkey"`   // owner key
+	Signature []byte    `json:"signature"`
+	Private   bool      `json:"private"`
+	Received  []byte    `json:"received"` // bitmap of the chunks we have
+	Updated   time.Time `json:"updated"`
+}
+
+type UploadNotFoundError struct{}
+
+func (e *UploadNotFoundError) Error() string {
+	return "no upload in progress for that hash"
+}
+
+// uploadTable holds the uploads in progress by uploadKey
+type uploadTable struct {
+	mut     sync.Mutex
+	uploads map[string]*upload
+}
+
+// uploadKey names an upload in the table and its staging directory. Every
+// key uploads a file on its own, so nobody can hold a file up by starting
+// an upload of it first, if several keys upload it the first one to be
+// stored owns it.
+func uploadKey(hash string, publicKey []byte) string {
+	return fileName(hash) + "." + hex.EncodeToString(publicKey)
+}
+
+func newUploadTable() *uploadTable {
+	return &uploadTable{uploads: make(map[string]*upload)}
+}
+
+// verifyHashSignature checks an ED25519 signature over a raw SHA-256 hash
+func verifyHashSignature(hash []byte, publicKey []byte, sig []byte) error {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return &InvalidPublicKeyError{}
+	}
+	if len(sig) != ed25519.SignatureSize || !ed25519.Verify(ed25519.PublicKey(publicKey), hash, sig) {
+		return &InvalidSignatureError{}
+	}
+	return nil
+}
+
+func (u *upload) has(index uint32) bool {
+	return u.received[index/8]&(1<<(index%8)) != 0
+}
+
+func (u *upload) set(index uint32) {
+	u.received[index/8] |= 1 << (index % 8)
+}
+
+func (u *upload) missing() []uint32 {
+	out := make([]uint32, 0)
+	for i := uint32(0); i < u.Manifest.ChunkCount(); i++ {
+		if !u.has(i) {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// save writes the upload state, the caller must hold the upload table lock
+func (u *upload) save() error {
+	state, err := json.Marshal(uploadState{
+		Manifest:  u.Manifest.Encode(),
+		PublicKey: u.PublicKey,
+		Signature: u.Signature,
+		Private:   u.Private,
+		Received:  u.received,
+		Updated:   u.updated,
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(u.dir+"/"+uploadStateFile, state, 0600)
+}
+
+// loadUpload reads the state of an upload from its staging directory, chunks
+// that are missing or don't match the manifest are marked as not received
+func loadUpload(dir string) (*upload, error) {
+	raw, err := ioutil.ReadFile(dir + "/" + uploadStateFile)
+	if err != nil {
+		return nil, err
+	}
+	state := uploadState{}
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return nil, err
+	}
+	m, err := eternityProto.DecodeManifest(state.Manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &upload{
+		Manifest:  m,
+		PublicKey: state.PublicKey,
+		Signature: state.Signature,
+		Private:   state.Private,
+		received:  make([]byte, (m.ChunkCount()+7)/8),
+		updated:   state.Updated,
+		dir:       dir,
+	}
+	if len(state.Received) != len(u.received) {
+		return nil, &eternityProto.InvalidManifestError{Reason: "received bitmap does not match the manifest"}
+	}
+	for i := uint32(0); i < m.ChunkCount(); i++ {
+		if state.Received[i/8]&(1<<(i%8)) == 0 {
+			continue
+		}
+		chunk, err := ioutil.ReadFile(u.chunkPath(i))
+		if err == nil && m.VerifyChunk(i, chunk) == nil {
+			u.set(i)
+		}
+	}
+	return u, nil
+}
+
+func (u *upload) key() string {
+	return uploadKey(base64.StdEncoding.EncodeToString(u.Manifest.FileHash), u.PublicKey)
+}
+
+func (u *upload) chunkPath(index uint32) string {
+	return fmt.Sprintf("%s/%d", u.dir, index)
+}
+
+// BeginUpload starts a chunked upload described by the manifest, sig must be
+// a signature of the file hash by publicKey. If an upload of the same file
+// by the same key is already in progress it is resumed. The chunks still
+// needed are returned, an empty list means the file is stored. An empty
+// file has no chunks to wait for and is stored right away.
+func (efs EternityFS) BeginUpload(m eternityProto.Manifest, publicKey []byte, sig []byte, private bool) ([]uint32, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	if err := verifyHashSignature(m.FileHash, publicKey, sig); err != nil {
+		return nil, err
+	}
+
+	hash := base64.StdEncoding.EncodeToString(m.FileHash)
+	if m.ChunkCount() == 0 {
+		if stored, err := efs.storedFor(hash, publicKey); err != nil {
+			return nil, err
+		} else if stored {
+			return []uint32{}, nil
+		}
+		u := &upload{Manifest: m, PublicKey: publicKey, Signature: sig, Private: private}
+		return []uint32{}, efs.finishUpload(u)
+	}
+
+	key := uploadKey(hash, publicKey)
+	efs.uploads.mut.Lock()
+	if u, ok := efs.uploads.uploads[key]; ok {
+		missing := u.missing()
+		finishing := u.finishing
+		efs.uploads.mut.Unlock()
+		if finishing != nil {
+			return efs.awaitUpload(u, hash, nil)
+		}
+		return missing, nil
+	}
+	defer efs.uploads.mut.Unlock()
+	// checked under the lock, uploads leave the table once they are stored
+	if stored, err := efs.storedFor(hash, publicKey); err != nil {
+		return nil, err
+	} else if stored {
+		return []uint32{}, nil
+	}
+
+	u := &upload{
+		Manifest:  m,
+		PublicKey: publicKey,
+		Signature: sig,
+		Private:   private,
+		received:  make([]byte, (m.ChunkCount()+7)/8),
+		updated:   time.Now(),
+		dir:       efs.Opts.StagingDir + "/" + key,
+	}
+	if err := os.MkdirAll(u.dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := u.save(); err != nil {
+		os.RemoveAll(u.dir)
+		return nil, err
+	}
+	efs.uploads.uploads[key] = u
+
+	return u.missing(), nil
+}
+
+// StoreChunk saves one chunk of the upload of a file by publicKey, sig must
+// be a signature of eternityProto.ChunkSignatureData by that key. Until it
+// verifies nothing is told about the upload, it is not found. The chunks
+// still missing are returned, once that list is empty the file has been
+// assembled and stored.
+func (efs EternityFS) StoreChunk(hash string, publicKey []byte, index uint32, chunk []byte, sig []byte) ([]uint32, error) {
+	rawHash, err := base64.StdEncoding.DecodeString(hash)
+	if err != nil || verifyHashSignature(eternityProto.ChunkSignatureData(rawHash, index), publicKey, sig) != nil {
+		return nil, &UploadNotFoundError{}
+	}
+
+	key := uploadKey(hash, publicKey)
+	efs.uploads.mut.Lock()
+	u, ok := efs.uploads.uploads[key]
+	var finishing chan struct{}
+	if ok {
+		finishing = u.finishing
+	}
+	efs.uploads.mut.Unlock()
+	if !ok {
+		return efs.uploadGone(hash, publicKey, nil)
+	}
+	if finishing != nil {
+		return efs.awaitUpload(u, hash, nil)
+	}
+
+	if err := u.Manifest.VerifyChunk(index, chunk); err != nil {
+		return nil, err
+	}
+	// a duplicated chunk may arrive while the upload is being assembled, it
+	// must replace the chunk file whole and never truncate it
+	writeErr := writeFileAtomic(u.chunkPath(index), chunk, 0600)
+
+	efs.uploads.mut.Lock()
+	if u.finishing != nil {
+		// a copy of the last chunk is finishing the upload
+		efs.uploads.mut.Unlock()
+		return efs.awaitUpload(u, hash, nil)
+	}
+	if writeErr != nil {
+		efs.uploads.mut.Unlock()
+		return nil, writeErr
+	}
+	u.set(index)
+	u.updated = time.Now()
+	missing := u.missing()
+	if len(missing) > 0 {
+		err := u.save()
+		efs.uploads.mut.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return missing, nil
+	}
+	// nobody else should finish this upload, it stays in the table until
+	// it is stored so copies of its manifest and chunks wait for it
+	u.finishing = make(chan struct{})
+	efs.uploads.mut.Unlock()
+
+	err = efs.finishUpload(u)
+
+	efs.uploads.mut.Lock()
+	delete(efs.uploads.uploads, key)
+	close(u.finishing)
+	efs.uploads.mut.Unlock()
+	return missing, err
+}
+
+// awaitUpload waits for an upload that is being assembled to be stored, or
+// to fail, and answers for the file like uploadGone. The file is reported
+// stored to whoever is adding to the upload, even if it is private.
+func (efs EternityFS) awaitUpload(u *upload, hash string, sig []byte) ([]uint32, error) {
+	<-u.finishing
+	return efs.uploadGone(hash, u.PublicKey, sig)
+}
+
+// uploadGone answers for an upload that is no longer in progress, it
+// finished while the request was in flight or it never began. A private
+// file is only reported stored to its owner, publicKey or the signer of sig
+// for reading, to anyone else it was never uploaded.
+func (efs EternityFS) uploadGone(hash string, publicKey []byte, sig []byte) ([]uint32, error) {
+	if efs.Authorize(hash, sig) == nil {
+		return []uint32{}, nil
+	}
+	if stored, _ := efs.storedFor(hash, publicKey); stored {
+		return []uint32{}, nil
+	}
+	return nil, &UploadNotFoundError{}
+}
+
+// storedFor tells whether an upload by publicKey has nothing left to send
+// because the file is already stored, public files stored under another key
+// can not be uploaded again. Private files of another key are not stored as
+// far as publicKey can tell, the upload goes ahead and is refused once the
+// whole file has been sent, when the uploader has shown they have it.
+func (efs EternityFS) storedFor(hash string, publicKey []byte) (bool, error) {
+	efs.mut.RLock()
+	entry, ok := efs.FileMap[hash]
+	efs.mut.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	if entry.PublicKey != "" && entry.PublicKey != base64.StdEncoding.EncodeToString(publicKey) {
+		if entry.Private {
+			return false, nil
+		}
+		return false, &FileOwnedError{}
+	}
+	return true, nil
+}
+
+// chunkReader reads the chunks of an upload one after the other as the
+// assembled file
+type chunkReader struct {
+	u    *upload
+	next uint32
+	cur  *os.File
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if r.next == r.u.Manifest.ChunkCount() {
+				return 0, io.EOF
+			}
+			chunk, err := os.Open(r.u.chunkPath(r.next))
+			if err != nil {
+				return 0, err
+			}
+			r.cur = chunk
+			r.next++
+		}
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	return r.cur.Close()
+}
+
+// finishUpload streams the chunks of a complete upload into a stored file,
+// the signature was checked against the manifest hash when it began. Empty
+// files have no chunks and no staging directory.
+func (efs EternityFS) finishUpload(u *upload) error {
+	if u.dir != "" {
+		defer os.RemoveAll(u.dir)
+	}
+
+	chunks := &chunkReader{u: u}
+	tmpPath, m, err := efs.writeTemp(chunks)
+	chunks.Close()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(m.FileHash, u.Manifest.FileHash) {
+		os.Remove(tmpPath)
+		return &eternityProto.InvalidManifestError{Reason: "assembled file does not match the manifest hash"}
+	}
+	_, err = efs.commit(tmpPath, m, u.PublicKey, u.Signature, u.Private)
+	return err
+}
+
+// UploadStatus returns the chunks still missing from an upload by publicKey
+// in progress, an empty list means the file is already stored. It is only
+// told to the uploader, sig must be a signature of
+// eternityProto.ReadSignatureData by publicKey or the upload is not found.
+func (efs EternityFS) UploadStatus(hash string, publicKey []byte, sig []byte) ([]uint32, error) {
+	rawHash, err := base64.StdEncoding.DecodeString(hash)
+	if err != nil || verifyHashSignature(eternityProto.ReadSignatureData(rawHash), publicKey, sig) != nil {
+		return nil, &UploadNotFoundError{}
+	}
+
+	efs.uploads.mut.Lock()
+	u, ok := efs.uploads.uploads[uploadKey(hash, publicKey)]
+	var missing []uint32
+	var finishing chan struct{}
+	if ok {
+		missing = u.missing()
+		finishing = u.finishing
+	}
+	efs.uploads.mut.Unlock()
+
+	if finishing != nil {
+		return efs.awaitUpload(u, hash, sig)
+	}
+	if ok {
+		return missing, nil
+	}
+	return efs.uploadGone(hash, publicKey, sig)
+}
+
+// CollectUploads removes uploads that have not received a chunk within the
+// staging timeout and returns how many were removed
+func (efs EternityFS) CollectUploads() int {
+	timeout := time.Duration(efs.Opts.StagingTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = DefaultStagingTimeout * time.Second
+	}
+	cutoff := time.Now().Add(-timeout)
+
+	efs.uploads.mut.Lock()
+	defer efs.uploads.mut.Unlock()
+	removed := 0
+	for key, u := range efs.uploads.uploads {
+		if u.finishing == nil && u.updated.Before(cutoff) {
+			log.Printf("removing stale upload %s", key)
+			os.RemoveAll(u.dir)
+			delete(efs.uploads.uploads, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// RunUploadCollector calls CollectUploads every interval until stop is
+// closed
+func (efs EternityFS) RunUploadCollector(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			efs.CollectUploads()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Manifest is the manifest of a stored file for chunked serving, it is
+// built once when the file is stored or indexed
+func (efs EternityFS) Manifest(hash string) (eternityProto.Manifest, error) {
+	efs.mut.RLock()
+	defer efs.mut.RUnlock()
+	m, ok := efs.manifests[hash]
+	if _, stored := efs.FileMap[hash]; !ok || !stored {
+		return eternityProto.Manifest{}, &FileNotFoundError{}
+	}
+	return m, nil
+}
+
+// GetChunk reads one chunk of a stored file, chunks are DefaultChunkSize
+// bytes as described by Manifest
+func (efs EternityFS) GetChunk(hash string, index uint32) ([]byte, error) {
+	efs.mut.RLock()
+	entry, ok := efs.FileMap[hash]
+	efs.mut.RUnlock()
+	if !ok {
+		return nil, &FileNotFoundError{}
+	}
+
+	file, err := os.Open(entry.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	m := eternityProto.Manifest{Size: uint64(info.Size()), ChunkSize: eternityProto.DefaultChunkSize}
+	if uint64(index)*uint64(m.ChunkSize) >= m.Size {
+		return nil, &eternityProto.InvalidManifestError{Reason: fmt.Sprintf("chunk index %d out of range", index)}
+	}
+	offset, length := m.ChunkBounds(index)
+
+	chunk := make([]byte, length)
+	if _, err := file.ReadAt(chunk, offset); err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
+
+// loadStaging restores the uploads saved in the staging directory, anything
+// we can't make sense of is removed
+func (efs EternityFS) loadStaging() error {
+	if err := os.MkdirAll(efs.Opts.StagingDir, 0700); err != nil {
+		return err
+	}
+	items, err := ioutil.ReadDir(efs.Opts.StagingDir)
+	if err != nil {
+		return err
+	}
+
+	efs.uploads.mut.Lock()
+	defer efs.uploads.mut.Unlock()
+	for _, item := range items {
+		path := efs.Opts.StagingDir + "/" + item.Name()
+		if !item.IsDir() {
+			os.Remove(path)
+			continue
+		}
+		u, err := loadUpload(path)
+		if err != nil {
+			log.Printf("removing unreadable upload %s: %v", path, err)
+			os.RemoveAll(path)
+			continue
+		}
+		efs.uploads.uploads[u.key()] = u
+	}
+	return nil
+}
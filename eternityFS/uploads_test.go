@@ -0,0 +1,323 @@
+package eternityFS
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"eternity/eternityProto"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func testEFS(t *testing.T) EternityFS {
+	t.Helper()
+	efs, err := InitEFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("InitEFS: %v", err)
+	}
+	return efs
+}
+
+func chunkSig(priv ed25519.PrivateKey, m eternityProto.Manifest, index uint32) []byte {
+	return ed25519.Sign(priv, eternityProto.ChunkSignatureData(m.FileHash, index))
+}
+
+func statusSig(priv ed25519.PrivateKey, m eternityProto.Manifest) []byte {
+	return ed25519.Sign(priv, eternityProto.ReadSignatureData(m.FileHash))
+}
+
+func testKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, priv
+}
+
+func TestUploadEmptyFile(t *testing.T) {
+	efs := testEFS(t)
+	pub, priv := testKey(t)
+
+	m := eternityProto.NewManifest(nil, eternityProto.DefaultChunkSize)
+	if m.ChunkCount() != 0 {
+		t.Fatalf("empty file has %d chunks", m.ChunkCount())
+	}
+	missing, err := efs.BeginUpload(m, pub, ed25519.Sign(priv, m.FileHash), false)
+	if err != nil {
+		t.Fatalf("BeginUpload: %v", err)
+	}
+	if len(missing) != 0 {
+		t.Fatalf("missing %v, want none", missing)
+	}
+
+	emptyHash := sha256.Sum256(nil)
+	hash := base64.StdEncoding.EncodeToString(emptyHash[:])
+	if !efs.Search(hash) {
+		t.Fatalf("empty file reported stored but not found")
+	}
+	file, err := efs.GetFile(hash)
+	if err != nil || len(file) != 0 {
+		t.Fatalf("GetFile: %q, %v", file, err)
+	}
+}
+
+func TestUploadEmptyManifestWrongHash(t *testing.T) {
+	efs := testEFS(t)
+	pub, priv := testKey(t)
+
+	m := eternityProto.NewManifest(nil, eternityProto.DefaultChunkSize)
+	m.FileHash = bytes.Repeat([]byte{1}, eternityProto.HashLength)
+	if _, err := efs.BeginUpload(m, pub, ed25519.Sign(priv, m.FileHash), false); err == nil {
+		t.Fatalf("stored an empty file under the hash of another")
+	}
+	if efs.Search(base64.StdEncoding.EncodeToString(m.FileHash)) {
+		t.Fatalf("file stored under the wrong hash")
+	}
+}
+
+// the mixnet duplicates messages, copies of a chunk arriving while the
+// upload is assembled must not damage the stored file
+func TestUploadDuplicatedChunks(t *testing.T) {
+	efs := testEFS(t)
+	pub, priv := testKey(t)
+
+	file := make([]byte, 64*1024+100)
+	rand.New(rand.NewSource(1)).Read(file)
+	m := eternityProto.NewManifest(file, 1024)
+	if _, err := efs.BeginUpload(m, pub, ed25519.Sign(priv, m.FileHash), false); err != nil {
+		t.Fatalf("BeginUpload: %v", err)
+	}
+	hash := base64.StdEncoding.EncodeToString(m.FileHash)
+
+	var wg sync.WaitGroup
+	for copies := 0; copies < 8; copies++ {
+		// and so can copies of the manifest, up to the moment it is stored
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				missing, err := efs.BeginUpload(m, pub, ed25519.Sign(priv, m.FileHash), false)
+				if err != nil {
+					t.Errorf("BeginUpload: %v", err)
+					return
+				}
+				if len(missing) == 0 {
+					if !efs.Search(hash) {
+						t.Errorf("upload reported stored before it was")
+					}
+					return
+				}
+			}
+		}()
+		for i := uint32(0); i < m.ChunkCount(); i++ {
+			wg.Add(1)
+			go func(index uint32) {
+				defer wg.Done()
+				var notFoundErr *UploadNotFoundError
+				if _, err := efs.StoreChunk(hash, pub, index, m.Chunk(file, index), chunkSig(priv, m, index)); err != nil && !errors.As(err, &notFoundErr) {
+					t.Errorf("StoreChunk %d: %v", index, err)
+				}
+			}(i)
+		}
+	}
+	wg.Wait()
+
+	stored, err := efs.GetFile(hash)
+	if err != nil {
+		t.Fatalf("GetFile: %v", err)
+	}
+	if !bytes.Equal(stored, file) {
+		t.Fatalf("stored file differs from the upload")
+	}
+	missing, err := efs.UploadStatus(hash, pub, statusSig(priv, m))
+	if err != nil || len(missing) != 0 {
+		t.Fatalf("UploadStatus: %v, %v", missing, err)
+	}
+	if staged, _ := ioutil.ReadDir(efs.Opts.StagingDir); len(staged) != 0 {
+		t.Fatalf("%d uploads left in staging", len(staged))
+	}
+}
+
+// nobody but the owner may learn from the upload requests that a private
+// file is stored, or being uploaded
+func TestPrivateUploadHidden(t *testing.T) {
+	efs := testEFS(t)
+	pub, priv := testKey(t)
+	otherPub, otherPriv := testKey(t)
+
+	file := make([]byte, 3000)
+	rand.New(rand.NewSource(2)).Read(file)
+	m := eternityProto.NewManifest(file, 1024)
+	hash := base64.StdEncoding.EncodeToString(m.FileHash)
+	readSig := ed25519.Sign(priv, eternityProto.ReadSignatureData(m.FileHash))
+	var notFoundErr *UploadNotFoundError
+
+	if _, err := efs.BeginUpload(m, pub, ed25519.Sign(priv, m.FileHash), true); err != nil {
+		t.Fatalf("BeginUpload: %v", err)
+	}
+	if _, err := efs.UploadStatus(hash, pub, nil); !errors.As(err, &notFoundErr) {
+		t.Fatalf("UploadStatus of a private upload without a signature: %v", err)
+	}
+	if missing, err := efs.UploadStatus(hash, pub, readSig); err != nil || len(missing) != int(m.ChunkCount()) {
+		t.Fatalf("UploadStatus by the owner: %v, %v", missing, err)
+	}
+	for i := uint32(0); i < m.ChunkCount(); i++ {
+		if _, err := efs.StoreChunk(hash, pub, i, m.Chunk(file, i), chunkSig(priv, m, i)); err != nil {
+			t.Fatalf("StoreChunk %d: %v", i, err)
+		}
+	}
+
+	if missing, err := efs.StoreChunk(hash, pub, 0, m.Chunk(file, 0), chunkSig(priv, m, 0)); err != nil || len(missing) != 0 {
+		t.Fatalf("StoreChunk by the owner after the file is stored: %v, %v", missing, err)
+	}
+	if _, err := efs.StoreChunk(hash, otherPub, 0, m.Chunk(file, 0), chunkSig(otherPriv, m, 0)); !errors.As(err, &notFoundErr) {
+		t.Fatalf("StoreChunk by another key after a private file is stored: %v", err)
+	}
+	if _, err := efs.UploadStatus(hash, pub, nil); !errors.As(err, &notFoundErr) {
+		t.Fatalf("UploadStatus of a private file without a signature: %v", err)
+	}
+	if missing, err := efs.UploadStatus(hash, pub, readSig); err != nil || len(missing) != 0 {
+		t.Fatalf("UploadStatus by the owner: %v, %v", missing, err)
+	}
+	if missing, err := efs.BeginUpload(m, pub, ed25519.Sign(priv, m.FileHash), true); err != nil || len(missing) != 0 {
+		t.Fatalf("BeginUpload by the owner: %v, %v", missing, err)
+	}
+
+	// another key has to send the whole file before it is refused
+	missing, err := efs.BeginUpload(m, otherPub, ed25519.Sign(otherPriv, m.FileHash), false)
+	if err != nil || len(missing) != int(m.ChunkCount()) {
+		t.Fatalf("BeginUpload by another key: %v, %v", missing, err)
+	}
+	if missing, err := efs.BeginUpload(m, pub, ed25519.Sign(priv, m.FileHash), true); err != nil || len(missing) != 0 {
+		t.Fatalf("BeginUpload by the owner during another upload: %v, %v", missing, err)
+	}
+	for i := uint32(0); i < m.ChunkCount()-1; i++ {
+		if _, err := efs.StoreChunk(hash, otherPub, i, m.Chunk(file, i), chunkSig(otherPriv, m, i)); err != nil {
+			t.Fatalf("StoreChunk %d: %v", i, err)
+		}
+	}
+	var ownedErr *FileOwnedError
+	last := m.ChunkCount() - 1
+	if _, err := efs.StoreChunk(hash, otherPub, last, m.Chunk(file, last), chunkSig(otherPriv, m, last)); !errors.As(err, &ownedErr) {
+		t.Fatalf("last chunk by another key: %v, want FileOwnedError", err)
+	}
+	if efs.Authorize(hash, nil) == nil {
+		t.Fatalf("another key made the private file public")
+	}
+}
+
+// an upload of a file by one key must not hold up the upload of the same
+// file by another, the first one stored owns the file
+func TestUploadSameFileByTwoKeys(t *testing.T) {
+	efs := testEFS(t)
+	squatterPub, squatterPriv := testKey(t)
+	ownerPub, ownerPriv := testKey(t)
+
+	file := make([]byte, 3000)
+	rand.New(rand.NewSource(3)).Read(file)
+	m := eternityProto.NewManifest(file, 1024)
+	hash := base64.StdEncoding.EncodeToString(m.FileHash)
+
+	if _, err := efs.BeginUpload(m, squatterPub, ed25519.Sign(squatterPriv, m.FileHash), false); err != nil {
+		t.Fatalf("BeginUpload by the first key: %v", err)
+	}
+	if _, err := efs.StoreChunk(hash, squatterPub, 0, m.Chunk(file, 0), chunkSig(squatterPriv, m, 0)); err != nil {
+		t.Fatalf("StoreChunk by the first key: %v", err)
+	}
+
+	missing, err := efs.BeginUpload(m, ownerPub, ed25519.Sign(ownerPriv, m.FileHash), false)
+	if err != nil || len(missing) != int(m.ChunkCount()) {
+		t.Fatalf("BeginUpload by the second key: %v, %v", missing, err)
+	}
+	// chunks of one upload don't count for the other
+	if _, err := efs.StoreChunk(hash, squatterPub, 1, m.Chunk(file, 1), chunkSig(squatterPriv, m, 1)); err != nil {
+		t.Fatalf("StoreChunk by the first key: %v", err)
+	}
+	if missing, err := efs.UploadStatus(hash, ownerPub, statusSig(ownerPriv, m)); err != nil || len(missing) != int(m.ChunkCount()) {
+		t.Fatalf("UploadStatus of the second key: %v, %v", missing, err)
+	}
+	for _, i := range missing {
+		if _, err := efs.StoreChunk(hash, ownerPub, i, m.Chunk(file, i), chunkSig(ownerPriv, m, i)); err != nil {
+			t.Fatalf("StoreChunk %d by the second key: %v", i, err)
+		}
+	}
+	if entry, ok := efs.FileMap[hash]; !ok || entry.PublicKey != base64.StdEncoding.EncodeToString(ownerPub) {
+		t.Fatalf("file not stored by the second key: %+v", entry)
+	}
+
+	var ownedErr *FileOwnedError
+	if _, err := efs.StoreChunk(hash, squatterPub, 2, m.Chunk(file, 2), chunkSig(squatterPriv, m, 2)); !errors.As(err, &ownedErr) {
+		t.Fatalf("finishing the first upload: %v, want FileOwnedError", err)
+	}
+	if staged, _ := ioutil.ReadDir(efs.Opts.StagingDir); len(staged) != 0 {
+		t.Fatalf("%d uploads left in staging", len(staged))
+	}
+}
+
+// someone who knows the hash of a private upload and its owner key, but
+// can't sign for it, learns nothing about it
+func TestProbePrivateUpload(t *testing.T) {
+	efs := testEFS(t)
+	pub, priv := testKey(t)
+	otherPub, otherPriv := testKey(t)
+
+	file := make([]byte, 3000)
+	rand.New(rand.NewSource(4)).Read(file)
+	m := eternityProto.NewManifest(file, 1024)
+	hash := base64.StdEncoding.EncodeToString(m.FileHash)
+	if _, err := efs.BeginUpload(m, pub, ed25519.Sign(priv, m.FileHash), true); err != nil {
+		t.Fatalf("BeginUpload: %v", err)
+	}
+	if _, err := efs.StoreChunk(hash, pub, 0, m.Chunk(file, 0), chunkSig(priv, m, 0)); err != nil {
+		t.Fatalf("StoreChunk: %v", err)
+	}
+
+	probes := []struct {
+		name  string
+		probe func() ([]uint32, error)
+	}{
+		{"chunk without a signature", func() ([]uint32, error) {
+			return efs.StoreChunk(hash, pub, 1, m.Chunk(file, 1), nil)
+		}},
+		{"chunk signed by another key", func() ([]uint32, error) {
+			return efs.StoreChunk(hash, pub, 1, m.Chunk(file, 1), chunkSig(otherPriv, m, 1))
+		}},
+		{"chunk signed for another index", func() ([]uint32, error) {
+			return efs.StoreChunk(hash, pub, 1, m.Chunk(file, 1), chunkSig(priv, m, 0))
+		}},
+		{"bad chunk signed by another key", func() ([]uint32, error) {
+			return efs.StoreChunk(hash, pub, 1, []byte("junk"), chunkSig(otherPriv, m, 1))
+		}},
+		{"chunk of another key", func() ([]uint32, error) {
+			return efs.StoreChunk(hash, otherPub, 1, m.Chunk(file, 1), chunkSig(otherPriv, m, 1))
+		}},
+		{"status without a signature", func() ([]uint32, error) {
+			return efs.UploadStatus(hash, pub, nil)
+		}},
+		{"status signed by another key", func() ([]uint32, error) {
+			return efs.UploadStatus(hash, pub, statusSig(otherPriv, m))
+		}},
+		{"status of another key", func() ([]uint32, error) {
+			return efs.UploadStatus(hash, otherPub, statusSig(otherPriv, m))
+		}},
+	}
+	for _, p := range probes {
+		t.Run(p.name, func(t *testing.T) {
+			var notFoundErr *UploadNotFoundError
+			if missing, err := p.probe(); !errors.As(err, &notFoundErr) {
+				t.Fatalf("probe answered %v, %v, want UploadNotFoundError", missing, err)
+			}
+		})
+	}
+
+	// nothing the probes sent was taken
+	missing, err := efs.UploadStatus(hash, pub, statusSig(priv, m))
+	if err != nil || len(missing) != int(m.ChunkCount())-1 {
+		t.Fatalf("UploadStatus by the owner: %v, %v", missing, err)
+	}
+}
@@ -0,0 +1,476 @@
+package eternityProto
+
+/*****************
+
+The eternity protocol is carried inside the message of a nym frame. Every
+request and response starts with a header, followed by any number of
+fields. Fields we do not know are skipped so new fields can be added
+without breaking older peers.
+
+# Request
+1 byte   	: 	Magic (high nibble, 0xE) and protocol version (low nibble)
+8 bytes  	: 	Request ID, chosen by the client
+1 byte   	: 	Action
+fields
+
+# Response
+1 byte   	: 	Magic and protocol version
+8 bytes  	: 	Request ID of the request being answered
+1 byte   	: 	Action of the request being answered
+1 byte   	: 	Status
+fields
+
+# Field
+1 byte   	: 	Field tag
+4 bytes  	: 	Field Length (FL)
+FL bytes 	: 	Field data
+
+# Fields per action
+search   	: 	request Hash
+store    	: 	request PublicKey, Signature of the SHA-256 hash of Body,
+					Body, optional Visibility; response Hash
+serve    	: 	request Hash; response Body, files over MaxServeSize are
+					refused, fetch them with serve manifest and serve chunk
+delete   	: 	request Hash, Timestamp, Signature of
+					DeleteSignatureData(hash, timestamp)
+any failed response may carry an Error field with a readable message
+
+# Private files
+A file stored with Visibility private can only be searched for and served
+by its owner, search, serve, serve manifest and serve chunk requests for
+it must carry a Signature of ReadSignatureData(hash) by the owner key. To
+anyone else a private file is not found.
+
+# Deleting files
+The owner signs DeleteSignatureData, the hash and the time of the request
+behind their own prefix, so neither a store nor a read signature can pass
+for one. A delete signed before the file was last stored is refused, which
+keeps an old delete from being replayed after the file is stored again.
+
+# Chunked transfers (see manifest.go)
+store manifest	: 	request Manifest, PublicKey, Signature (of the file
+					hash), optional Visibility; response Missing chunk
+					indexes
+store chunk   	: 	request Hash, PublicKey, Index, Body, Signature of
+					ChunkSignatureData(hash, index); response Missing
+					chunk indexes, and Hash once the file is stored
+serve manifest	: 	request Hash; response Manifest
+serve chunk   	: 	request Hash, Index; response Body
+upload status 	: 	request Hash, PublicKey, Signature of
+					ReadSignatureData(hash); response Missing chunk
+					indexes of an upload in progress, empty if the file
+					is stored
+every key uploads a file on its own, chunks and status requests name the
+upload by its hash and the PublicKey it was started with. Until their
+signature by that key verifies the upload is not found, so nobody else
+learns of it.
+
+*****************/
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+const Magic = 0xE0
+const Version = 0x01
+
+const requestHeaderLength = 1 + 8 + 1
+const responseHeaderLength = requestHeaderLength + 1
+const fieldHeaderLength = 1 + 4
+
+const HashLength = 32
+const PublicKeyLength = 32
+const SignatureLength = 64
+
+type Action byte
+
+const (
+	ActionSearch Action = 0x00
+	ActionStore  Action = 0x01
+	ActionServe  Action = 0x02
+	ActionDelete Action = 0x03
+
+	// chunked transfers, for files bigger than one nym message
+	ActionStoreManifest Action = 0x04
+	ActionStoreChunk    Action = 0x05
+	ActionServeManifest Action = 0x06
+	ActionServeChunk    Action = 0x07
+	ActionUploadStatus  Action = 0x08
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionSearch:
+		return "search"
+	case ActionStore:
+		return "store"
+	case ActionServe:
+		return "serve"
+	case ActionDelete:
+		return "delete"
+	case ActionStoreManifest:
+		return "store manifest"
+	case ActionStoreChunk:
+		return "store chunk"
+	case ActionServeManifest:
+		return "serve manifest"
+	case ActionServeChunk:
+		return "serve chunk"
+	case ActionUploadStatus:
+		return "upload status"
+	}
+	return "unknown"
+}
+
+type Field byte
+
+const (
+	FieldHash      Field = 0x01
+	FieldPublicKey Field = 0x02
+	FieldSignature Field = 0x03
+	FieldBody      Field = 0x04
+	FieldError     Field = 0x05
+	FieldManifest  Field = 0x06
+	FieldIndex     Field = 0x07 // chunk index, 4 bytes big endian
+	FieldMissing   Field = 0x08 // list of 4 byte chunk indexes
+
+	FieldVisibility Field = 0x09 // 1 byte, see Visibility
+	FieldTimestamp  Field = 0x0A // 8 bytes big endian, unix seconds
+)
+
+// Visibility says who may read a stored file, files are public unless
+// stored otherwise
+type Visibility byte
+
+const (
+	VisibilityPublic  Visibility = 0x00
+	VisibilityPrivate Visibility = 0x01
+)
+
+func (v Visibility) String() string {
+	switch v {
+	case VisibilityPublic:
+		return "public"
+	case VisibilityPrivate:
+		return "private"
+	}
+	return "unknown"
+}
+
+// DecodeVisibility reads a Visibility field
+func DecodeVisibility(data []byte) (Visibility, error) {
+	if len(data) != 1 {
+		return 0, &FieldLengthError{Field: FieldVisibility, Want: 1, Have: len(data)}
+	}
+	v := Visibility(data[0])
+	if v != VisibilityPublic && v != VisibilityPrivate {
+		return 0, &UnknownVisibilityError{Visibility: v}
+	}
+	return v, nil
+}
+
+// ReadSignatureData is what the owner of a private file signs to read it,
+// prefixed so a read signature can never pass as a delete signature
+func ReadSignatureData(hash []byte) []byte {
+	return append([]byte("eternity read "), hash...)
+}
+
+// ChunkSignatureData is what an uploader signs for each chunk they send
+func ChunkSignatureData(hash []byte, index uint32) []byte {
+	data := append([]byte("eternity chunk "), hash...)
+	return append(data, EncodeIndex(index)...)
+}
+
+// DeleteSignatureData is what the owner of a file signs to delete it
+func DeleteSignatureData(hash []byte, timestamp time.Time) []byte {
+	data := append([]byte("eternity delete "), hash...)
+	return append(data, EncodeTimestamp(timestamp)...)
+}
+
+func EncodeTimestamp(t time.Time) []byte {
+	out := make([]byte, 8)
+	binary.BigEndian.PutUint64(out, uint64(t.Unix()))
+	return out
+}
+
+func DecodeTimestamp(raw []byte) time.Time {
+	return time.Unix(int64(binary.BigEndian.Uint64(raw)), 0)
+}
+
+// fixed sizes of fields, fields not listed here can be any length
+var fieldLengths = map[Field]int{
+	FieldHash:       HashLength,
+	FieldPublicKey:  PublicKeyLength,
+	FieldSignature:  SignatureLength,
+	FieldIndex:      4,
+	FieldVisibility: 1,
+	FieldTimestamp:  8,
+}
+
+// fields a request must carry for each action
+var requiredFields = map[Action][]Field{
+	ActionSearch: {FieldHash},
+	ActionStore:  {FieldPublicKey, FieldSignature, FieldBody},
+	ActionServe:  {FieldHash},
+	ActionDelete: {FieldHash, FieldTimestamp, FieldSignature},
+
+	ActionStoreManifest: {FieldManifest, FieldPublicKey, FieldSignature},
+	ActionStoreChunk:    {FieldHash, FieldPublicKey, FieldIndex, FieldBody, FieldSignature},
+	ActionServeManifest: {FieldHash},
+	ActionServeChunk:    {FieldHash, FieldIndex},
+	ActionUploadStatus:  {FieldHash, FieldPublicKey, FieldSignature},
+}
+
+type Request struct {
+	ID     uint64
+	Action Action
+	Fields map[Field][]byte
+}
+
+type Response struct {
+	ID     uint64
+	Action Action
+	Status Status
+	Fields map[Field][]byte
+}
+
+func NewSearchRequest(id uint64, hash []byte) Request {
+	return Request{ID: id, Action: ActionSearch, Fields: map[Field][]byte{
+		FieldHash: hash,
+	}}
+}
+
+func NewStoreRequest(id uint64, publicKey []byte, sig []byte, body []byte) Request {
+	return Request{ID: id, Action: ActionStore, Fields: map[Field][]byte{
+		FieldPublicKey: publicKey,
+		FieldSignature: sig,
+		FieldBody:      body,
+	}}
+}
+
+func NewServeRequest(id uint64, hash []byte) Request {
+	return Request{ID: id, Action: ActionServe, Fields: map[Field][]byte{
+		FieldHash: hash,
+	}}
+}
+
+func NewStoreManifestRequest(id uint64, m Manifest, publicKey []byte, sig []byte) Request {
+	return Request{ID: id, Action: ActionStoreManifest, Fields: map[Field][]byte{
+		FieldManifest:  m.Encode(),
+		FieldPublicKey: publicKey,
+		FieldSignature: sig,
+	}}
+}
+
+func NewStoreChunkRequest(id uint64, hash []byte, publicKey []byte, index uint32, chunk []byte, sig []byte) Request {
+	return Request{ID: id, Action: ActionStoreChunk, Fields: map[Field][]byte{
+		FieldHash:      hash,
+		FieldPublicKey: publicKey,
+		FieldIndex:     EncodeIndex(index),
+		FieldBody:      chunk,
+		FieldSignature: sig,
+	}}
+}
+
+func NewServeManifestRequest(id uint64, hash []byte) Request {
+	return Request{ID: id, Action: ActionServeManifest, Fields: map[Field][]byte{
+		FieldHash: hash,
+	}}
+}
+
+func NewServeChunkRequest(id uint64, hash []byte, index uint32) Request {
+	return Request{ID: id, Action: ActionServeChunk, Fields: map[Field][]byte{
+		FieldHash:  hash,
+		FieldIndex: EncodeIndex(index),
+	}}
+}
+
+func NewUploadStatusRequest(id uint64, hash []byte, publicKey []byte, sig []byte) Request {
+	return Request{ID: id, Action: ActionUploadStatus, Fields: map[Field][]byte{
+		FieldHash:      hash,
+		FieldPublicKey: publicKey,
+		FieldSignature: sig,
+	}}
+}
+
+func NewDeleteRequest(id uint64, hash []byte, timestamp time.Time, sig []byte) Request {
+	return Request{ID: id, Action: ActionDelete, Fields: map[Field][]byte{
+		FieldHash:      hash,
+		FieldTimestamp: EncodeTimestamp(timestamp),
+		FieldSignature: sig,
+	}}
+}
+
+// NewResponse starts the response to a request, fields can be added with Set
+func NewResponse(req Request, status Status) Response {
+	return Response{ID: req.ID, Action: req.Action, Status: status, Fields: make(map[Field][]byte)}
+}
+
+// Set adds a field to the request and returns it, for chaining
+func (r Request) Set(field Field, data []byte) Request {
+	if r.Fields == nil {
+		r.Fields = make(map[Field][]byte)
+	}
+	r.Fields[field] = data
+	return r
+}
+
+// Set adds a field to the response and returns it, for chaining
+func (r Response) Set(field Field, data []byte) Response {
+	if r.Fields == nil {
+		r.Fields = make(map[Field][]byte)
+	}
+	r.Fields[field] = data
+	return r
+}
+
+func (r Request) Get(field Field) []byte {
+	return r.Fields[field]
+}
+
+func (r Response) Get(field Field) []byte {
+	return r.Fields[field]
+}
+
+// Err returns nil for a successful response and a *StatusError otherwise
+func (r Response) Err() error {
+	if r.Status == StatusOK {
+		return nil
+	}
+	return &StatusError{Status: r.Status, Message: string(r.Fields[FieldError])}
+}
+
+func encodeFields(out []byte, fields map[Field][]byte) []byte {
+	// encode in tag order so the same request always has the same bytes
+	tags := make([]int, 0, len(fields))
+	for tag := range fields {
+		tags = append(tags, int(tag))
+	}
+	sort.Ints(tags)
+
+	length := make([]byte, 4)
+	for _, tag := range tags {
+		data := fields[Field(tag)]
+		binary.BigEndian.PutUint32(length, uint32(len(data)))
+		out = append(out, byte(tag))
+		out = append(out, length...)
+		out = append(out, data...)
+	}
+	return out
+}
+
+func decodeFields(data []byte) (map[Field][]byte, error) {
+	fields := make(map[Field][]byte)
+	for len(data) > 0 {
+		if len(data) < fieldHeaderLength {
+			return nil, &TruncatedFrameError{Need: fieldHeaderLength, Have: len(data)}
+		}
+		tag := Field(data[0])
+		length := binary.BigEndian.Uint32(data[1:fieldHeaderLength])
+		data = data[fieldHeaderLength:]
+		if uint64(length) > uint64(len(data)) {
+			return nil, &TruncatedFrameError{Need: int(length), Have: len(data)}
+		}
+		if _, ok := fields[tag]; ok {
+			return nil, &DuplicateFieldError{Field: tag}
+		}
+		fields[tag] = data[:length]
+		data = data[length:]
+	}
+	return fields, nil
+}
+
+func checkVersion(b byte) error {
+	if b&0xF0 != Magic {
+		return &BadMagicError{Got: b}
+	}
+	if b&0x0F != Version {
+		return &UnsupportedVersionError{Version: b & 0x0F}
+	}
+	return nil
+}
+
+func (r Request) Encode() []byte {
+	out := make([]byte, requestHeaderLength, requestHeaderLength+64)
+	out[0] = Magic | Version
+	binary.BigEndian.PutUint64(out[1:9], r.ID)
+	out[9] = byte(r.Action)
+	return encodeFields(out, r.Fields)
+}
+
+func (r Response) Encode() []byte {
+	out := make([]byte, responseHeaderLength, responseHeaderLength+64)
+	out[0] = Magic | Version
+	binary.BigEndian.PutUint64(out[1:9], r.ID)
+	out[9] = byte(r.Action)
+	out[10] = byte(r.Status)
+	return encodeFields(out, r.Fields)
+}
+
+// Validate checks that the request carries every field its action needs and
+// that fixed size fields have the right size
+func (r Request) Validate() error {
+	required, ok := requiredFields[r.Action]
+	if !ok {
+		return &UnknownActionError{Action: r.Action}
+	}
+	for _, field := range required {
+		if _, ok := r.Fields[field]; !ok {
+			return &MissingFieldError{Action: r.Action, Field: field}
+		}
+	}
+	for field, data := range r.Fields {
+		if want, ok := fieldLengths[field]; ok && len(data) != want {
+			return &FieldLengthError{Field: field, Want: want, Have: len(data)}
+		}
+	}
+	return nil
+}
+
+// DecodeRequest decodes and validates a request. If the header could be
+// read the returned request has its ID and action set even when an error is
+// returned, so the error can be reported back to the client.
+func DecodeRequest(raw []byte) (Request, error) {
+	if len(raw) < requestHeaderLength {
+		return Request{}, &TruncatedFrameError{Need: requestHeaderLength, Have: len(raw)}
+	}
+	if err := checkVersion(raw[0]); err != nil {
+		return Request{}, err
+	}
+
+	req := Request{
+		ID:     binary.BigEndian.Uint64(raw[1:9]),
+		Action: Action(raw[9]),
+	}
+	fields, err := decodeFields(raw[requestHeaderLength:])
+	if err != nil {
+		return req, err
+	}
+	req.Fields = fields
+
+	return req, req.Validate()
+}
+
+func DecodeResponse(raw []byte) (Response, error) {
+	if len(raw) < responseHeaderLength {
+		return Response{}, &TruncatedFrameError{Need: responseHeaderLength, Have: len(raw)}
+	}
+	if err := checkVersion(raw[0]); err != nil {
+		return Response{}, err
+	}
+
+	resp := Response{
+		ID:     binary.BigEndian.Uint64(raw[1:9]),
+		Action: Action(raw[9]),
+		Status: Status(raw[10]),
+	}
+	fields, err := decodeFields(raw[responseHeaderLength:])
+	if err != nil {
+		return resp, err
+	}
+	resp.Fields = fields
+
+	return resp, nil
+}
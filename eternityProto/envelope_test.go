@@ -0,0 +1,48 @@
+package eternityProto
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func FuzzDecodeRequest(f *testing.F) {
+	hash := bytes.Repeat([]byte{0xAB}, HashLength)
+	key := bytes.Repeat([]byte{0x01}, PublicKeyLength)
+	sig := bytes.Repeat([]byte{0x02}, SignatureLength)
+	m := NewManifest([]byte("a small file"), DefaultChunkSize)
+	for _, req := range []Request{
+		NewSearchRequest(1, hash),
+		NewStoreRequest(2, key, sig, []byte("body")).Set(FieldVisibility, []byte{byte(VisibilityPrivate)}),
+		NewServeRequest(3, hash),
+		NewDeleteRequest(4, hash, time.Unix(1700000000, 0), sig),
+		NewStoreManifestRequest(5, m, key, sig),
+		NewStoreChunkRequest(6, hash, key, 7, []byte("chunk"), sig),
+		NewServeManifestRequest(8, hash),
+		NewServeChunkRequest(9, hash, 10),
+		NewUploadStatusRequest(11, hash, key, sig),
+	} {
+		f.Add(req.Encode())
+	}
+	f.Add([]byte{Magic | Version})
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		req, err := DecodeRequest(raw)
+		if err != nil {
+			return
+		}
+		// a valid request survives being encoded again
+		again, err := DecodeRequest(req.Encode())
+		if err != nil {
+			t.Fatalf("re-encoded request does not decode: %v", err)
+		}
+		if again.ID != req.ID || again.Action != req.Action || len(again.Fields) != len(req.Fields) {
+			t.Fatalf("re-encoded request changed: %+v != %+v", again, req)
+		}
+		for field, data := range req.Fields {
+			if !bytes.Equal(again.Fields[field], data) {
+				t.Fatalf("field 0x%02x changed: %x != %x", byte(field), again.Fields[field], data)
+			}
+		}
+	})
+}
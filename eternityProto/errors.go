@@ -0,0 +1,122 @@
+package eternityProto
+
+import "fmt"
+
+type Status byte
+
+const (
+	StatusOK                 Status = 0x00
+	StatusNotFound           Status = 0x01
+	StatusBadRequest         Status = 0x02
+	StatusUnsupportedVersion Status = 0x03
+	StatusBadPublicKey       Status = 0x04
+	StatusBadSignature       Status = 0x05
+	StatusNoOwnerKey         Status = 0x06
+	StatusInternalError      Status = 0x07
+	StatusConflict           Status = 0x08
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusNotFound:
+		return "not found"
+	case StatusBadRequest:
+		return "bad request"
+	case StatusUnsupportedVersion:
+		return "unsupported version"
+	case StatusBadPublicKey:
+		return "bad public key"
+	case StatusBadSignature:
+		return "bad signature"
+	case StatusNoOwnerKey:
+		return "no owner key"
+	case StatusInternalError:
+		return "internal error"
+	case StatusConflict:
+		return "conflict"
+	}
+	return fmt.Sprintf("unknown status 0x%02x", byte(s))
+}
+
+// StatusError is a failed response from the server
+type StatusError struct {
+	Status  Status
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return e.Status.String()
+	}
+	return fmt.Sprintf("%s: %s", e.Status, e.Message)
+}
+
+type BadMagicError struct {
+	Got byte
+}
+
+func (e *BadMagicError) Error() string {
+	return fmt.Sprintf("not an eternity frame, first byte 0x%02x", e.Got)
+}
+
+type UnsupportedVersionError struct {
+	Version byte
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("unsupported protocol version %d", e.Version)
+}
+
+type TruncatedFrameError struct {
+	Need int
+	Have int
+}
+
+func (e *TruncatedFrameError) Error() string {
+	return fmt.Sprintf("truncated eternity frame: need %d bytes, have %d", e.Need, e.Have)
+}
+
+type UnknownActionError struct {
+	Action Action
+}
+
+func (e *UnknownActionError) Error() string {
+	return fmt.Sprintf("unknown request action 0x%02x", byte(e.Action))
+}
+
+type MissingFieldError struct {
+	Action Action
+	Field  Field
+}
+
+func (e *MissingFieldError) Error() string {
+	return fmt.Sprintf("%s request is missing field 0x%02x", e.Action, byte(e.Field))
+}
+
+type DuplicateFieldError struct {
+	Field Field
+}
+
+func (e *DuplicateFieldError) Error() string {
+	return fmt.Sprintf("field 0x%02x appears more than once", byte(e.Field))
+}
+
+type FieldLengthError struct {
+	Field Field
+	Want  int
+	Have  int
+}
+
+func (e *FieldLengthError) Error() string {
+	return fmt.Sprintf("field 0x%02x is %d bytes, expected %d", byte(e.Field), e.Have, e.Want)
+}
+
+type UnknownVisibilityError struct {
+	Visibility Visibility
+}
+
+func (e *UnknownVisibilityError) Error() string {
+	return fmt.Sprintf("unknown visibility 0x%02x", byte(e.Visibility))
+}
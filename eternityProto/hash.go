@@ -0,0 +1,33 @@
+package eternityProto
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+)
+
+type InvalidHashError struct {
+	Hash string
+}
+
+func (e *InvalidHashError) Error() string {
+	return "not a SHA-256 hash in hex or base64: " + e.Hash
+}
+
+// ParseHash reads a SHA-256 hash written in hex, url safe base64 or
+// standard base64, padded or not
+func ParseHash(s string) ([]byte, error) {
+	if len(s) == 2*HashLength {
+		if hash, err := hex.DecodeString(s); err == nil {
+			return hash, nil
+		}
+	}
+	for _, enc := range []*base64.Encoding{
+		base64.StdEncoding, base64.RawStdEncoding,
+		base64.URLEncoding, base64.RawURLEncoding,
+	} {
+		if hash, err := enc.DecodeString(s); err == nil && len(hash) == HashLength {
+			return hash, nil
+		}
+	}
+	return nil, &InvalidHashError{Hash: s}
+}
@@ -0,0 +1,205 @@
+package eternityProto
+
+/*****************
+
+Files too big for a single nym message are sent in chunks. The manifest
+describes how a file is split up:
+
+32 bytes 	: 	SHA256 Hash of the whole file
+8 bytes  	: 	File size
+4 bytes  	: 	Chunk size (CS), every chunk but the last is CS bytes
+4 bytes  	: 	Chunk count (CC)
+CC*32 bytes : 	SHA256 Hash of each chunk, in order
+
+*****************/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// DefaultChunkSize keeps each chunk comfortably inside one nym message
+const DefaultChunkSize = 32 * 1024
+
+// MaxChunkSize is the largest chunk a server will accept
+const MaxChunkSize = 1024 * 1024
+
+// MaxServeSize is the largest file a serve request returns whole, bigger
+// files are fetched with serve manifest and serve chunk
+const MaxServeSize = MaxChunkSize
+
+const manifestHeaderLength = HashLength + 8 + 4 + 4
+
+type Manifest struct {
+	FileHash    []byte
+	Size        uint64
+	ChunkSize   uint32
+	ChunkHashes [][]byte
+}
+
+type InvalidManifestError struct {
+	Reason string
+}
+
+func (e *InvalidManifestError) Error() string {
+	return "invalid manifest: " + e.Reason
+}
+
+type ChunkHashMismatchError struct {
+	Index uint32
+}
+
+func (e *ChunkHashMismatchError) Error() string {
+	return fmt.Sprintf("chunk %d does not match its hash in the manifest", e.Index)
+}
+
+// ManifestFromReader reads a file and builds its manifest
+func ManifestFromReader(r io.Reader, chunkSize uint32) (Manifest, error) {
+	m := Manifest{ChunkSize: chunkSize}
+	fileHash := sha256.New()
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			chunkHash := sha256.Sum256(buf[:n])
+			m.ChunkHashes = append(m.ChunkHashes, chunkHash[:])
+			fileHash.Write(buf[:n])
+			m.Size += uint64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return Manifest{}, err
+		}
+	}
+	m.FileHash = fileHash.Sum(nil)
+	return m, nil
+}
+
+// NewManifest builds the manifest of a file held in memory
+func NewManifest(file []byte, chunkSize uint32) Manifest {
+	m, _ := ManifestFromReader(bytes.NewReader(file), chunkSize)
+	return m
+}
+
+func (m Manifest) ChunkCount() uint32 {
+	return uint32(len(m.ChunkHashes))
+}
+
+// ChunkBounds returns the offset and length of a chunk in the file
+func (m Manifest) ChunkBounds(index uint32) (int64, int) {
+	offset := uint64(index) * uint64(m.ChunkSize)
+	length := uint64(m.ChunkSize)
+	if offset+length > m.Size {
+		length = m.Size - offset
+	}
+	return int64(offset), int(length)
+}
+
+// Chunk cuts a chunk out of a file held in memory
+func (m Manifest) Chunk(file []byte, index uint32) []byte {
+	offset, length := m.ChunkBounds(index)
+	return file[offset : offset+int64(length)]
+}
+
+func (m Manifest) VerifyChunk(index uint32, data []byte) error {
+	if index >= m.ChunkCount() {
+		return &InvalidManifestError{Reason: fmt.Sprintf("chunk index %d out of range", index)}
+	}
+	if _, length := m.ChunkBounds(index); length != len(data) {
+		return &ChunkHashMismatchError{Index: index}
+	}
+	chunkHash := sha256.Sum256(data)
+	if !bytes.Equal(chunkHash[:], m.ChunkHashes[index]) {
+		return &ChunkHashMismatchError{Index: index}
+	}
+	return nil
+}
+
+// Validate checks that the manifest is consistent with itself
+func (m Manifest) Validate() error {
+	if len(m.FileHash) != HashLength {
+		return &InvalidManifestError{Reason: "bad file hash length"}
+	}
+	if m.ChunkSize == 0 || m.ChunkSize > MaxChunkSize {
+		return &InvalidManifestError{Reason: "chunk size out of range"}
+	}
+	want := (m.Size + uint64(m.ChunkSize) - 1) / uint64(m.ChunkSize)
+	if uint64(len(m.ChunkHashes)) != want {
+		return &InvalidManifestError{Reason: "chunk count does not match file size"}
+	}
+	for _, chunkHash := range m.ChunkHashes {
+		if len(chunkHash) != HashLength {
+			return &InvalidManifestError{Reason: "bad chunk hash length"}
+		}
+	}
+	return nil
+}
+
+func (m Manifest) Encode() []byte {
+	out := make([]byte, manifestHeaderLength, manifestHeaderLength+len(m.ChunkHashes)*HashLength)
+	copy(out, m.FileHash)
+	binary.BigEndian.PutUint64(out[32:40], m.Size)
+	binary.BigEndian.PutUint32(out[40:44], m.ChunkSize)
+	binary.BigEndian.PutUint32(out[44:48], uint32(len(m.ChunkHashes)))
+	for _, chunkHash := range m.ChunkHashes {
+		out = append(out, chunkHash...)
+	}
+	return out
+}
+
+// DecodeManifest decodes and validates a manifest
+func DecodeManifest(raw []byte) (Manifest, error) {
+	if len(raw) < manifestHeaderLength {
+		return Manifest{}, &TruncatedFrameError{Need: manifestHeaderLength, Have: len(raw)}
+	}
+	m := Manifest{
+		FileHash:  raw[:32],
+		Size:      binary.BigEndian.Uint64(raw[32:40]),
+		ChunkSize: binary.BigEndian.Uint32(raw[40:44]),
+	}
+	count := uint64(binary.BigEndian.Uint32(raw[44:48]))
+	hashes := raw[manifestHeaderLength:]
+	if uint64(len(hashes)) != count*HashLength {
+		return Manifest{}, &InvalidManifestError{Reason: "chunk hash list does not match chunk count"}
+	}
+	m.ChunkHashes = make([][]byte, count)
+	for i := range m.ChunkHashes {
+		m.ChunkHashes[i] = hashes[i*HashLength : (i+1)*HashLength]
+	}
+	return m, m.Validate()
+}
+
+func EncodeIndex(index uint32) []byte {
+	out := make([]byte, 4)
+	binary.BigEndian.PutUint32(out, index)
+	return out
+}
+
+func DecodeIndex(raw []byte) uint32 {
+	return binary.BigEndian.Uint32(raw)
+}
+
+// EncodeIndexes encodes a list of chunk indexes, used for missing chunks
+func EncodeIndexes(indexes []uint32) []byte {
+	out := make([]byte, 0, len(indexes)*4)
+	for _, index := range indexes {
+		out = append(out, EncodeIndex(index)...)
+	}
+	return out
+}
+
+func DecodeIndexes(raw []byte) ([]uint32, error) {
+	if len(raw)%4 != 0 {
+		return nil, &FieldLengthError{Field: FieldMissing, Want: len(raw) / 4 * 4, Have: len(raw)}
+	}
+	out := make([]uint32, len(raw)/4)
+	for i := range out {
+		out[i] = DecodeIndex(raw[i*4 : i*4+4])
+	}
+	return out, nil
+}
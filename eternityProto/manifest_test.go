@@ -0,0 +1,31 @@
+package eternityProto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzDecodeManifest(f *testing.F) {
+	f.Add(NewManifest(nil, DefaultChunkSize).Encode())
+	f.Add(NewManifest([]byte("a small file"), DefaultChunkSize).Encode())
+	f.Add(NewManifest(bytes.Repeat([]byte("chunks"), 1000), 1024).Encode())
+	f.Add(make([]byte, manifestHeaderLength))
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		m, err := DecodeManifest(raw)
+		if err != nil {
+			return
+		}
+		// the encoding has only one form
+		if !bytes.Equal(m.Encode(), raw) {
+			t.Fatalf("manifest encodes to %x, decoded from %x", m.Encode(), raw)
+		}
+		for i := uint32(0); i < m.ChunkCount(); i++ {
+			offset, length := m.ChunkBounds(i)
+			if offset < 0 || length < 0 || length > int(m.ChunkSize) {
+				t.Fatalf("chunk %d has bounds %d+%d", i, offset, length)
+			}
+		}
+		m.VerifyChunk(m.ChunkCount(), nil)
+	})
+}
@@ -0,0 +1,216 @@
+package fakeNym
+
+import (
+	"errors"
+	"eternity/nymProto"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Client is one simulated nym-client. Like the real one it serves a single
+// websocket at a time, a new connection replaces the old one. Frames for the
+// client are kept until someone is connected to take them.
+type Client struct {
+	Address []byte // binary nym address, AddressLength bytes
+
+	mixnet   *Mixnet
+	listener *pipeListener
+	server   *http.Server
+	upgrader websocket.Upgrader
+
+	mut    sync.Mutex
+	conn   *websocket.Conn // the connected websocket, nil if there is none
+	inbox  [][]byte        // frames waiting to be written to conn
+	wake   chan struct{}
+	closed bool
+}
+
+func newClient(m *Mixnet, address []byte) *Client {
+	c := &Client{
+		Address:  address,
+		mixnet:   m,
+		listener: newPipeListener(),
+		wake:     make(chan struct{}, 1),
+	}
+	c.server = &http.Server{Handler: http.HandlerFunc(c.serveWebsocket)}
+	go c.server.Serve(c.listener)
+	go c.writer()
+	return c
+}
+
+// AddressString is the address in the text form used by ParseRecipient
+func (c *Client) AddressString() string {
+	return nymProto.FormatRecipient(c.Address)
+}
+
+// Dialer returns a websocket dialer that connects to this client in memory,
+// the URI passed to it does not matter
+func (c *Client) Dialer() *websocket.Dialer {
+	return &websocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			return c.listener.dial()
+		},
+	}
+}
+
+// Dial opens a websocket to the client, it fits WebSocketHandler.Dial
+func (c *Client) Dial() (*websocket.Conn, error) {
+	conn, _, err := c.Dialer().Dial("ws://fake-nym/", nil)
+	return conn, err
+}
+
+// Disconnect drops the connected websocket, as if nym-client went away
+func (c *Client) Disconnect() {
+	c.mut.Lock()
+	conn := c.conn
+	c.conn = nil
+	c.mut.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// Close removes the client from the mixnet and drops its connection
+func (c *Client) Close() error {
+	c.mut.Lock()
+	if c.closed {
+		c.mut.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mut.Unlock()
+
+	c.mixnet.remove(c)
+	c.Disconnect()
+	c.signal()
+	return c.server.Close()
+}
+
+func (c *Client) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver queues a frame for whoever is connected to the client
+func (c *Client) deliver(frame []byte) {
+	c.mut.Lock()
+	c.inbox = append(c.inbox, frame)
+	c.mut.Unlock()
+	c.signal()
+}
+
+// writer is the only goroutine writing to the websocket, frames that can't
+// be written stay in the inbox for the next connection
+func (c *Client) writer() {
+	for range c.wake {
+		for {
+			c.mut.Lock()
+			if c.closed {
+				c.mut.Unlock()
+				return
+			}
+			if c.conn == nil || len(c.inbox) == 0 {
+				c.mut.Unlock()
+				break
+			}
+			conn := c.conn
+			frame := c.inbox[0]
+			c.mut.Unlock()
+
+			if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+				c.mut.Lock()
+				if c.conn == conn {
+					c.conn = nil
+				}
+				c.mut.Unlock()
+				conn.Close()
+				break
+			}
+
+			c.mut.Lock()
+			c.inbox = c.inbox[1:]
+			c.mut.Unlock()
+		}
+	}
+}
+
+func (c *Client) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := c.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	c.mut.Lock()
+	if c.closed {
+		c.mut.Unlock()
+		conn.Close()
+		return
+	}
+	old := c.conn
+	c.conn = conn
+	c.mut.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	c.signal()
+
+	for {
+		_, frame, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		c.handleFrame(frame)
+	}
+
+	c.mut.Lock()
+	if c.conn == conn {
+		c.conn = nil
+	}
+	c.mut.Unlock()
+	conn.Close()
+}
+
+// handleFrame acts on one request from the websocket, bad requests are
+// answered with an error frame like nym-client does
+func (c *Client) handleFrame(frame []byte) {
+	if len(frame) == 0 {
+		c.deliver(nymProto.MakeError(nymProto.ErrorKindEmptyRequest, "empty request"))
+		return
+	}
+
+	var err error
+	switch frame[0] {
+	case nymProto.SelfAddressRequestTag:
+		if err = nymProto.ParseSelfAddressRequest(frame); err == nil {
+			c.deliver(nymProto.MakeSelfAddressResponse(c.Address))
+		}
+	case nymProto.SendRequestTag:
+		var req nymProto.SendRequest
+		if req, err = nymProto.ParseSendRequest(frame); err == nil {
+			err = c.mixnet.send(c, req)
+		}
+	case nymProto.ReplyRequestTag:
+		var req nymProto.ReplyRequest
+		if req, err = nymProto.ParseReplyRequest(frame); err == nil {
+			err = c.mixnet.reply(req)
+		}
+	default:
+		c.deliver(nymProto.MakeError(nymProto.ErrorKindUnknownRequest, "unknown request tag"))
+		return
+	}
+
+	if err != nil {
+		kind := nymProto.ErrorKindMalformedRequest
+		var surbErr *UnknownSURBError
+		var expiredErr *ExpiredSURBError
+		if errors.As(err, &surbErr) || errors.As(err, &expiredErr) {
+			kind = nymProto.ErrorKindOther
+		}
+		c.deliver(nymProto.MakeError(kind, err.Error()))
+	}
+}
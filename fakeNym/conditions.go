@@ -0,0 +1,127 @@
+package fakeNym
+
+import (
+	"math/rand"
+	"time"
+)
+
+// DelayFunc picks how long one message spends in the mixnet
+type DelayFunc func(r *rand.Rand) time.Duration
+
+// ConstantDelay delays every message by d
+func ConstantDelay(d time.Duration) DelayFunc {
+	return func(r *rand.Rand) time.Duration {
+		return d
+	}
+}
+
+// UniformDelay delays messages by anything between min and max
+func UniformDelay(min, max time.Duration) DelayFunc {
+	return func(r *rand.Rand) time.Duration {
+		if max <= min {
+			return min
+		}
+		return min + time.Duration(r.Int63n(int64(max-min)))
+	}
+}
+
+// ExponentialDelay delays messages with exponentially distributed delays
+// around mean, which is how nym mix nodes delay packets
+func ExponentialDelay(mean time.Duration) DelayFunc {
+	return func(r *rand.Rand) time.Duration {
+		return time.Duration(r.ExpFloat64() * float64(mean))
+	}
+}
+
+// Conditions describe how the simulated mixnet treats messages, the zero
+// value delivers everything at once and in order
+type Conditions struct {
+	Delay DelayFunc // nil for no delay
+
+	DropRate      float64 // chance a message is lost
+	DuplicateRate float64 // chance a message arrives twice
+
+	// chance a message is held back ReorderDelay longer than its delay, so
+	// messages sent after it overtake it
+	ReorderRate  float64
+	ReorderDelay time.Duration
+
+	// SURBs older than this no longer work, 0 keeps them forever
+	SURBLifetime time.Duration
+
+	// seeds the randomness so a run can be repeated, 0 picks a seed
+	Seed int64
+}
+
+// Stats counts what the mixnet did with the messages it was given
+type Stats struct {
+	Sent         int // messages and replies handed to the mixnet
+	Delivered    int // copies that reached a client
+	Dropped      int
+	Duplicated   int
+	Reordered    int
+	ExpiredSURBs int // replies refused because their SURB was too old
+}
+
+func newRand(seed int64) *rand.Rand {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed))
+}
+
+// chance is true with probability p, the caller must hold the mixnet lock
+func (m *Mixnet) chance(p float64) bool {
+	return p > 0 && m.rng.Float64() < p
+}
+
+// delay picks the delay of one message, the caller must hold the mixnet
+// lock
+func (m *Mixnet) delay() time.Duration {
+	var d time.Duration
+	if m.cond.Delay != nil {
+		d = m.cond.Delay(m.rng)
+	}
+	if m.chance(m.cond.ReorderRate) {
+		m.stats.Reordered++
+		d += m.cond.ReorderDelay
+	}
+	return d
+}
+
+// route hands a frame to a client once the simulated network is done with
+// it, it may be lost, delayed or arrive twice on the way
+func (m *Mixnet) route(to *Client, frame []byte) {
+	m.mut.Lock()
+	m.stats.Sent++
+	if m.chance(m.cond.DropRate) {
+		m.stats.Dropped++
+		m.mut.Unlock()
+		return
+	}
+	copies := 1
+	if m.chance(m.cond.DuplicateRate) {
+		m.stats.Duplicated++
+		copies = 2
+	}
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = m.delay()
+	}
+	m.mut.Unlock()
+
+	for _, d := range delays {
+		if d <= 0 {
+			m.handOver(to, frame)
+			continue
+		}
+		time.AfterFunc(d, func() { m.handOver(to, frame) })
+	}
+}
+
+func (m *Mixnet) handOver(to *Client, frame []byte) {
+	m.mut.Lock()
+	m.stats.Delivered++
+	m.mut.Unlock()
+	to.deliver(frame)
+}
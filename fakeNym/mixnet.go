@@ -0,0 +1,167 @@
+// Package fakeNym is an in-process stand-in for the nym native client. It
+// speaks the binary websocket protocol of nym-client (self address, send,
+// reply and received frames) and routes messages between the clients of a
+// Mixnet, handing out SURBs for replies, so eternity can be run end to end
+// without a gateway or a network. SetConditions makes the mixnet lose, delay,
+// duplicate and reorder messages and expire SURBs like a real one would:
+//
+//	mixnet := fakeNym.NewMixnet()
+//	server, _ := mixnet.NewClient()
+//	conn, _ := server.Dial()
+//	wsh, _ := nymLib.NewWebsocketHandler(conn, dataDir)
+//	wsh.Dial = server.Dial
+package fakeNym
+
+import (
+	crand "crypto/rand"
+	"eternity/nymProto"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// SURBLength is the length of the SURBs we hand out, real ones are longer
+// but their content means nothing to the receiver
+const SURBLength = 32
+
+type UnknownSURBError struct{}
+
+func (e *UnknownSURBError) Error() string {
+	return "unknown or already used SURB"
+}
+
+type ExpiredSURBError struct {
+	Age time.Duration
+}
+
+func (e *ExpiredSURBError) Error() string {
+	return fmt.Sprintf("SURB expired, it was issued %s ago", e.Age)
+}
+
+// surb is an unused SURB and who it leads back to
+type surb struct {
+	owner  *Client
+	issued time.Time
+}
+
+// Mixnet routes messages between its clients
+type Mixnet struct {
+	mut     sync.Mutex
+	clients map[string]*Client // keyed by binary address
+	surbs   map[string]surb
+	cond    Conditions
+	rng     *rand.Rand
+	stats   Stats
+}
+
+func NewMixnet() *Mixnet {
+	return &Mixnet{
+		clients: make(map[string]*Client),
+		surbs:   make(map[string]surb),
+		rng:     newRand(0),
+	}
+}
+
+// SetConditions changes how messages are treated from now on
+func (m *Mixnet) SetConditions(cond Conditions) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.cond = cond
+	m.rng = newRand(cond.Seed)
+}
+
+func (m *Mixnet) Stats() Stats {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.stats
+}
+
+// NewClient adds a client with a random address to the mixnet
+func (m *Mixnet) NewClient() (*Client, error) {
+	address := make([]byte, nymProto.AddressLength)
+	if _, err := crand.Read(address); err != nil {
+		return nil, err
+	}
+
+	c := newClient(m, address)
+	m.mut.Lock()
+	m.clients[string(address)] = c
+	m.mut.Unlock()
+	return c, nil
+}
+
+// Close shuts down every client of the mixnet
+func (m *Mixnet) Close() {
+	m.mut.Lock()
+	clients := make([]*Client, 0, len(m.clients))
+	for _, c := range m.clients {
+		clients = append(clients, c)
+	}
+	m.mut.Unlock()
+
+	for _, c := range clients {
+		c.Close()
+	}
+}
+
+func (m *Mixnet) remove(c *Client) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	delete(m.clients, string(c.Address))
+	for id, s := range m.surbs {
+		if s.owner == c {
+			delete(m.surbs, id)
+		}
+	}
+}
+
+// send delivers a message to its recipient, like the real mixnet a message
+// for an address nobody has is silently lost
+func (m *Mixnet) send(from *Client, req nymProto.SendRequest) error {
+	var replySURB []byte
+	if req.WithReplySURB {
+		replySURB = make([]byte, SURBLength)
+		if _, err := crand.Read(replySURB); err != nil {
+			return err
+		}
+	}
+
+	m.mut.Lock()
+	to, ok := m.clients[string(req.Recipient)]
+	if ok && replySURB != nil {
+		m.surbs[string(replySURB)] = surb{owner: from, issued: time.Now()}
+	}
+	m.mut.Unlock()
+
+	if ok {
+		m.route(to, nymProto.MakeReceived(req.Message, replySURB))
+	}
+	return nil
+}
+
+// reply delivers a message through a SURB, each SURB works once
+func (m *Mixnet) reply(req nymProto.ReplyRequest) error {
+	m.mut.Lock()
+	s, ok := m.surbs[string(req.SURB)]
+	delete(m.surbs, string(req.SURB))
+	lifetime := m.cond.SURBLifetime
+	if ok && lifetime > 0 && time.Since(s.issued) > lifetime {
+		m.stats.ExpiredSURBs++
+		m.mut.Unlock()
+		return &ExpiredSURBError{Age: time.Since(s.issued)}
+	}
+	m.mut.Unlock()
+	if !ok {
+		return &UnknownSURBError{}
+	}
+
+	m.route(s.owner, nymProto.MakeReceived(req.Message, nil))
+	return nil
+}
+
+func (m *Mixnet) String() string {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return fmt.Sprintf("fake mixnet with %d clients and %d unused SURBs", len(m.clients), len(m.surbs))
+}
@@ -1,5 +1,5 @@
 module eternity
 
-go 1.17
+go 1.18
 
 require github.com/gorilla/websocket v1.4.2
@@ -0,0 +1,90 @@
+// Package httpGateway serves the public files of an eternityFS over plain
+// HTTP for people without a nym-client. Files are read only, by hash:
+//
+//	GET /f/<hash>
+//
+// where the hash is the SHA-256 of the file in hex, url safe base64 or
+// standard base64. Private files are never served, they are not found.
+package httpGateway
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"eternity/eternityFS"
+	"eternity/eternityProto"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// FilePrefix is the path files are served under
+const FilePrefix = "/f/"
+
+// files never change under their hash so they can be cached for good
+const cacheControl = "public, max-age=31536000, immutable"
+
+type Gateway struct {
+	Efs eternityFS.EternityFS
+}
+
+func NewGateway(efs eternityFS.EternityFS) *Gateway {
+	return &Gateway{Efs: efs}
+}
+
+// Handler routes FilePrefix to the gateway and 404s everything else. It is
+// not a ServeMux, which cleans paths and would redirect a standard base64
+// hash holding "//" away from its file.
+func (g *Gateway) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, FilePrefix) {
+			http.NotFound(w, r)
+			return
+		}
+		g.ServeHTTP(w, r)
+	})
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// standard base64 may hold a '/', so the hash is the rest of the path
+	rawHash, err := eternityProto.ParseHash(strings.TrimPrefix(r.URL.Path, FilePrefix))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hash := base64.StdEncoding.EncodeToString(rawHash)
+
+	// without a signature private files are not found
+	if err := g.Efs.Authorize(hash, nil); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	file, err := g.Efs.Open(hash)
+	var notFoundErr *eternityFS.FileNotFoundError
+	if errors.As(err, &notFoundErr) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("http gateway: reading %s: %v", hash, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	name := hex.EncodeToString(rawHash)
+	w.Header().Set("ETag", `"`+name+`"`)
+	w.Header().Set("Cache-Control", cacheControl)
+	// anyone can publish a file, keep browsers from running what they get
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	// the name has no extension so ServeContent sniffs the content type,
+	// and it handles ranges, HEAD and If-None-Match against the ETag
+	http.ServeContent(w, r, name, time.Time{}, file)
+}
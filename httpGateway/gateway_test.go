@@ -0,0 +1,206 @@
+package httpGateway
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"eternity/eternityFS"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fileWithHash finds a file whose standard base64 hash holds substr
+func fileWithHash(t *testing.T, substr string) ([]byte, []byte) {
+	t.Helper()
+	for i := 0; i < 100000; i++ {
+		file := []byte(fmt.Sprintf("file %d", i))
+		hash := sha256.Sum256(file)
+		if strings.Contains(base64.StdEncoding.EncodeToString(hash[:]), substr) {
+			return file, hash[:]
+		}
+	}
+	t.Fatalf("no file with %q in its hash", substr)
+	return nil, nil
+}
+
+func TestServeHashEncodings(t *testing.T) {
+	efs, err := eternityFS.InitEFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("InitEFS: %v", err)
+	}
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, hash := fileWithHash(t, "//")
+	fileHash := sha256.Sum256(file)
+	if _, err := efs.Store(file, pub, ed25519.Sign(priv, fileHash[:]), false); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	srv := httptest.NewServer(NewGateway(efs).Handler())
+	defer srv.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	tests := []struct {
+		name string
+		path string
+		want int
+	}{
+		{"hex", FilePrefix + hex.EncodeToString(hash), http.StatusOK},
+		{"url safe base64", FilePrefix + base64.RawURLEncoding.EncodeToString(hash), http.StatusOK},
+		{"standard base64", FilePrefix + base64.StdEncoding.EncodeToString(hash), http.StatusOK},
+		{"outside the prefix", "/" + hex.EncodeToString(hash), http.StatusNotFound},
+		{"missing", FilePrefix + strings.Repeat("00", sha256.Size), http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := client.Get(srv.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("GET %s: status %d, want %d", tt.path, resp.StatusCode, tt.want)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil || string(body) != string(file) {
+				t.Fatalf("GET %s: %q, %v", tt.path, body, err)
+			}
+		})
+	}
+}
+
+func TestServeHeaders(t *testing.T) {
+	efs, err := eternityFS.InitEFS(t.TempDir())
+	if err != nil {
+		t.Fatalf("InitEFS: %v", err)
+	}
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := func(file []byte, private bool) string {
+		hash := sha256.Sum256(file)
+		if _, err := efs.Store(file, pub, ed25519.Sign(priv, hash[:]), private); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		return hex.EncodeToString(hash[:])
+	}
+	text := []byte("plain text served over http")
+	textHash := store(text, false)
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 32)...)
+	pngHash := store(png, false)
+	secretHash := store([]byte("only for its owner"), true)
+
+	srv := httptest.NewServer(NewGateway(efs).Handler())
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		method  string
+		hash    string
+		header  map[string]string
+		want    int
+		body    string
+		headers map[string]string
+	}{
+		{
+			name: "private without a signature", method: http.MethodGet, hash: secretHash,
+			want: http.StatusNotFound,
+		},
+		{
+			name: "text", method: http.MethodGet, hash: textHash,
+			want: http.StatusOK, body: string(text),
+			headers: map[string]string{
+				"Content-Type":            "text/plain; charset=utf-8",
+				"ETag":                    `"` + textHash + `"`,
+				"Cache-Control":           cacheControl,
+				"X-Content-Type-Options":  "nosniff",
+				"Content-Security-Policy": "sandbox",
+			},
+		},
+		{
+			name: "image", method: http.MethodGet, hash: pngHash,
+			want: http.StatusOK, body: string(png),
+			headers: map[string]string{"Content-Type": "image/png"},
+		},
+		{
+			name: "range", method: http.MethodGet, hash: textHash,
+			header: map[string]string{"Range": "bytes=6-9"},
+			want:   http.StatusPartialContent, body: "text",
+			headers: map[string]string{"Content-Range": fmt.Sprintf("bytes 6-9/%d", len(text))},
+		},
+		{
+			name: "range past the end", method: http.MethodGet, hash: textHash,
+			header: map[string]string{"Range": fmt.Sprintf("bytes=%d-", len(text)+10)},
+			want:   http.StatusRequestedRangeNotSatisfiable,
+		},
+		{
+			name: "head", method: http.MethodHead, hash: textHash,
+			want: http.StatusOK, body: "",
+			headers: map[string]string{
+				"Content-Length": fmt.Sprint(len(text)),
+				"Content-Type":   "text/plain; charset=utf-8",
+			},
+		},
+		{
+			name: "if none match", method: http.MethodGet, hash: textHash,
+			header: map[string]string{"If-None-Match": `"` + textHash + `"`},
+			want:   http.StatusNotModified, body: "",
+		},
+		{
+			name: "if none match another file", method: http.MethodGet, hash: textHash,
+			header: map[string]string{"If-None-Match": `"` + pngHash + `"`},
+			want:   http.StatusOK, body: string(text),
+		},
+		{
+			name: "post", method: http.MethodPost, hash: textHash,
+			want:    http.StatusMethodNotAllowed,
+			headers: map[string]string{"Allow": "GET, HEAD"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, srv.URL+FilePrefix+tt.hash, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key, value := range tt.header {
+				req.Header.Set(key, value)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.want)
+			}
+			for key, want := range tt.headers {
+				if got := resp.Header.Get(key); got != want {
+					t.Errorf("%s: %q, want %q", key, got, want)
+				}
+			}
+			if tt.want != http.StatusOK && tt.want != http.StatusPartialContent && tt.want != http.StatusNotModified {
+				return
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil || string(body) != tt.body {
+				t.Fatalf("body %q, want %q: %v", body, tt.body, err)
+			}
+		})
+	}
+}
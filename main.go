@@ -1,63 +1,193 @@
 package main
 
 import (
+	"eternity/eternityFS"
+	"eternity/httpGateway"
 	nL "eternity/nymLib"
 
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
-
-	"github.com/gorilla/websocket"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-// fServe "eternity/eternityFS"
+const usage = `usage: eternity <command> [flags]
+
+commands:
+	serve	run an eternity server behind a nym-client
+	address	print the nym address users reach the server at
+
+run "eternity <command> -h" for the flags of a command
+`
 
-// "github.com/gorilla/websocket"
+// how long queued requests get to finish after SIGINT or SIGTERM
+const shutdownTimeout = 30 * time.Second
 
 func main() {
-	// nL.StartEternityServerNymClientWatcher()
-	// nL.SendBinaryWithReply()
-
-	// could put some gateway bs here
-
-	// uri := "ws://localhost:1977"
-
-	// conn, _, err := websocket.DefaultDialer.Dial(uri, nil)
-	// if err != nil {
-	// 	panic(err)
-	// }
-	// wsh := nL.NewWebsocketHandler(conn)
-
-	// go wsh.RequestProcessor()
-	// println("starting reader routine")
-	// for {
-	// 	_, receivedResponse, err := wsh.Conn.ReadMessage()
-	// 	if err != nil {
-	// 		panic(err)
-	// 	}
-
-	// 	request, err := nL.ParseReceived(receivedResponse)
-	// 	if err == nil {
-	// 		wsh.RequestQueue <- request
-	// 	}
-	// }
-	// check if we can marshal the reponse
-	uri := "ws://localhost:1977"
-
-	conn, _, err := websocket.DefaultDialer.Dial(uri, nil)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "serve":
+		if err := serve(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	case "address":
+		if err := address(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+}
+
+// serve connects to nym-client and answers requests until the connection
+// to nym-client is lost or we are told to stop
+func serve(args []string) error {
+	cfg, err := loadConfig("eternity serve", args)
+	if err != nil {
+		return err
+	}
+	cfg.Print(os.Stdout)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	efs, err := eternityFS.InitEFS(cfg.DataDir)
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	// nil unless we launch nym-client, gets the error if it crashes too often
+	var supFailed chan error
+	if cfg.LaunchNymClient {
+		opts := nL.NymClientOpts{
+			Binary:  cfg.NymBinary,
+			ID:      cfg.NymID,
+			Gateway: cfg.NymGateway,
+			Port:    cfg.NymPort(),
+			Args:    cfg.NymArgs,
+		}
+		initAddress, err := nL.EnsureNymClient(ctx, opts)
+		if err != nil {
+			return err
+		}
+		if initAddress != "" {
+			if err := efs.SetNymAddress(initAddress); err != nil {
+				return err
+			}
+		}
+
+		sup := nL.NewNymClientSupervisor(opts)
+		sup.MaxRestarts = cfg.NymMaxRestarts
+		// nym-client outlives the handler so the last replies get out
+		supCtx, stopSup := context.WithCancel(context.Background())
+		supDone := make(chan struct{})
+		supFailed = make(chan error, 1)
+		go func() {
+			if err := sup.Run(supCtx); err != nil {
+				supFailed <- err
+			}
+			close(supDone)
+		}()
+		defer func() {
+			stopSup()
+			<-supDone
+		}()
+
+		if err := sup.WaitReady(ctx); err != nil {
+			return err
+		}
 	}
-	defer conn.Close()
 
-	for {
-		_, receivedResponse, err := conn.ReadMessage()
+	if cfg.HTTPListen != "" {
+		stopHTTP, err := serveHTTP(cfg.HTTPListen, efs)
 		if err != nil {
-			panic(err)
+			return err
+		}
+		defer stopHTTP()
+	}
+
+	dial := nL.DialNymClient(cfg.NymURI)
+	conn, err := dial()
+	if err != nil {
+		return err
+	}
+
+	wsh := nL.NewEFSHandler(conn, efs)
+	wsh.Dial = dial
+
+	wsh.Start(ctx)
+	log.Printf("serving %s over %s", cfg.DataDir, cfg.NymURI)
+
+	var supErr error
+	select {
+	case <-wsh.Done():
+		if err := wsh.Err(); err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		// a second signal kills us straight away
+		stop()
+		log.Printf("shutting down, finishing queued requests")
+	case supErr = <-supFailed:
+		log.Printf("shutting down: %v", supErr)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := wsh.Stop(shutdownCtx); err != nil {
+		return err
+	}
+	return supErr
+}
+
+// serveHTTP starts the HTTP gateway for public files, the returned func
+// stops it and waits for requests in progress
+func serveHTTP(addr string, efs eternityFS.EternityFS) (func(), error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{
+		Handler:           httpGateway.NewGateway(efs).Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("http gateway: %v", err)
 		}
+	}()
+	log.Printf("serving public files on http://%s%s", l.Addr(), httpGateway.FilePrefix)
 
-		fileData, _ := nL.ParseReceived(receivedResponse)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}, nil
+}
 
-		fmt.Printf("writing the file back to the disk!\n")
-		ioutil.WriteFile("received_file_withreply", fileData.Body, 0644)
+// address prints the nym address saved by the server in its data directory
+func address(args []string) error {
+	cfg, err := loadConfig("eternity address", args)
+	if err != nil {
+		return err
+	}
+	address, err := eternityFS.StoredNymAddress(cfg.DataDir)
+	if err != nil {
+		return err
 	}
+	fmt.Println(address)
+	return nil
 }
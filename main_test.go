@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"eternity/eternityFS"
+	"eternity/eternityProto"
+	"eternity/fakeNym"
+	"eternity/nymProto"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// set in the environment of the test binary when it is run as nym-client,
+// the websocket it passes frames on to, the address init prints and where
+// it writes its pid
+const (
+	fakeNymUpstreamEnv = "ETERNITY_TEST_NYM_UPSTREAM"
+	fakeNymAddressEnv  = "ETERNITY_TEST_NYM_ADDRESS"
+	fakeNymPidEnv      = "ETERNITY_TEST_NYM_PID"
+)
+
+func TestMain(m *testing.M) {
+	if upstream := os.Getenv(fakeNymUpstreamEnv); upstream != "" {
+		runFakeNymClient(upstream, os.Args[1:])
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runFakeNymClient stands in for nym-client. init prints the address like
+// the real one, run listens on --port and passes frames between whoever
+// connects and upstream. On SIGINT it stops listening and exits once the
+// connections it has are closed.
+func runFakeNymClient(upstream string, args []string) {
+	if len(args) > 0 && args[0] == "init" {
+		fmt.Printf("The address of this client is: %s\n", os.Getenv(fakeNymAddressEnv))
+		return
+	}
+	port := ""
+	for i, arg := range args {
+		if arg == "--port" && i+1 < len(args) {
+			port = args[i+1]
+		}
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		os.Exit(1)
+	}
+	ioutil.WriteFile(os.Getenv(fakeNymPidEnv), []byte(strconv.Itoa(os.Getpid())), 0644)
+
+	var conns sync.WaitGroup
+	upgrader := websocket.Upgrader{}
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns.Add(1)
+		defer conns.Done()
+		other, _, err := websocket.DefaultDialer.Dial(upstream, nil)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		pipeFrames(conn, other)
+	}))
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	<-interrupted
+	l.Close()
+	done := make(chan struct{})
+	go func() {
+		conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+	}
+	os.Exit(0)
+}
+
+// pipeFrames passes frames between two websockets until either closes
+func pipeFrames(a *websocket.Conn, b *websocket.Conn) {
+	defer a.Close()
+	defer b.Close()
+	go func() {
+		for {
+			_, frame, err := b.ReadMessage()
+			if err != nil {
+				a.Close()
+				return
+			}
+			a.WriteMessage(websocket.BinaryMessage, frame)
+		}
+	}()
+	for {
+		_, frame, err := a.ReadMessage()
+		if err != nil {
+			return
+		}
+		b.WriteMessage(websocket.BinaryMessage, frame)
+	}
+}
+
+// On SIGINT serve stops reading requests, answers every request it has
+// already read, saves its config and stops the nym-client it launched
+func TestServeDrainsOnInterrupt(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("HOME", t.TempDir())
+
+	mixnet := fakeNym.NewMixnet()
+	defer mixnet.Close()
+	serverClient, err := mixnet.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	userClient, err := mixnet.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the launched nym-client passes frames on to the server's fake client
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		nymConn, err := serverClient.Dial()
+		if err != nil {
+			conn.Close()
+			return
+		}
+		pipeFrames(conn, nymConn)
+	}))
+	defer upstream.Close()
+	pidFile := filepath.Join(t.TempDir(), "nym-client.pid")
+	t.Setenv(fakeNymUpstreamEnv, "ws"+strings.TrimPrefix(upstream.URL, "http"))
+	t.Setenv(fakeNymAddressEnv, serverClient.AddressString())
+	t.Setenv(fakeNymPidEnv, pidFile)
+
+	dataDir := t.TempDir()
+	port := freePort(t)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve([]string{
+			"-data-dir", dataDir,
+			"-nym-uri", "ws://localhost:" + port,
+			"-launch-nym-client",
+			"-nym-binary", os.Args[0],
+			"-nym-id", "test",
+			"-nym-gateway", "test",
+		})
+	}()
+
+	user, err := userClient.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer user.Close()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const requests = 50
+	for i := 0; i < requests; i++ {
+		file := []byte(fmt.Sprintf("file %d", i))
+		hash := sha256.Sum256(file)
+		req := eternityProto.NewStoreRequest(uint64(i), pub, ed25519.Sign(priv, hash[:]), file)
+		if err := user.WriteMessage(websocket.BinaryMessage, nymProto.MakeSendRequest(serverClient.Address, req.Encode(), true)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first reply shows the server is up, the rest are in flight
+	replied := make(map[string]bool)
+	readReply := func(timeout time.Duration) bool {
+		user.SetReadDeadline(time.Now().Add(timeout))
+		_, frame, err := user.ReadMessage()
+		if err != nil {
+			return false
+		}
+		received, err := nymProto.ParseReceived(frame)
+		if err != nil {
+			t.Fatalf("user received %x: %v", frame, err)
+		}
+		resp, err := eternityProto.DecodeResponse(received.Message)
+		if err != nil {
+			t.Fatalf("reply %x: %v", received.Message, err)
+		}
+		if err := resp.Err(); err != nil {
+			t.Fatalf("reply to %d: %v", resp.ID, err)
+		}
+		replied[base64.StdEncoding.EncodeToString(resp.Get(eternityProto.FieldHash))] = true
+		return true
+	}
+	if !readReply(30 * time.Second) {
+		t.Fatalf("no reply from the server")
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("serve: %v", err)
+		}
+	case <-time.After(shutdownTimeout):
+		t.Fatalf("serve did not return after SIGINT")
+	}
+	for readReply(2 * time.Second) {
+	}
+
+	// every request that was read, and so stored, was answered
+	efs, err := eternityFS.InitEFS(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for hash := range efs.FileMap {
+		if !replied[hash] {
+			t.Errorf("%s was stored without a reply", hash)
+		}
+	}
+	if len(replied) != len(efs.FileMap) {
+		t.Errorf("%d replies for %d stored files", len(replied), len(efs.FileMap))
+	}
+	if address, err := eternityFS.StoredNymAddress(dataDir); err != nil || address != serverClient.AddressString() {
+		t.Errorf("saved nym address %q, %v, want the one init printed", address, err)
+	}
+
+	// and nym-client is gone
+	raw, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("nym-client was never run: %v", err)
+	}
+	pid, _ := strconv.Atoi(string(raw))
+	if err := syscall.Kill(pid, 0); !errors.Is(err, syscall.ESRCH) {
+		t.Fatalf("nym-client %d still running after serve returned: %v", pid, err)
+	}
+	if conn, err := net.Dial("tcp", "localhost:"+port); err == nil {
+		conn.Close()
+		t.Fatalf("nym-client port still open after serve returned")
+	}
+}
+
+func freePort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
@@ -1,116 +1,64 @@
 package nymLib
 
 import (
-	"encoding/binary"
 	"encoding/json"
+	"eternity/eternityProto"
+	"eternity/nymProto"
 	"fmt"
 
 	"github.com/gorilla/websocket"
 )
 
-const sendRequestTag = 0x00
-const replyRequestTag = 0x01
-const selfAddressRequestTag = 0x02
-
-// response tags
-const errorResponseTag = 0x00
-const receivedResponseTag = 0x01
-const selfAddressResponseTag = 0x02
-
 type InvalidRequestError struct{}
 
 func (m *InvalidRequestError) Error() string {
 	return "malformed or invalid request"
 }
 
-func MakeSelfAddressRequest() []byte {
-	return []byte{selfAddressRequestTag}
-}
-
-func parseSelfAddressResponse(rawResponse []byte) []byte {
-	if len(rawResponse) != 97 || rawResponse[0] != selfAddressResponseTag {
-		panic("Received invalid response")
+// ParseReceived decodes a received frame into a request for the server, any
+// malformed input is reported as an error. If the eternity header could be
+// read the request has its SURB, ID and action set even when an error is
+// returned, so the client can be told what went wrong.
+func ParseReceived(rawResponse []byte) (ServerRequest, error) {
+	received, err := nymProto.ParseReceived(rawResponse)
+	if err != nil {
+		return ServerRequest{}, err
 	}
-	return rawResponse[1:]
-}
-
-func MakeSendRequest(recipient []byte, message []byte, withReplySurb bool) []byte {
-	messageLen := make([]byte, 8)
-	binary.BigEndian.PutUint64(messageLen, uint64(len(message)))
-
-	surbByte := byte(0)
-	if withReplySurb {
-		surbByte = 1
+	if !received.HasSURB() {
+		// we can't answer a request without a SURB
+		return ServerRequest{}, &InvalidRequestError{}
 	}
 
-	out := []byte{sendRequestTag, surbByte}
-	fmt.Printf("request tag and surb byte is %d bytes long\n", len(out))
-	fmt.Printf("the recipient is %d bytes long\n", len(recipient))
-	out = append(out, recipient...)
-	out = append(out, messageLen...)
-	out = append(out, message...)
-
-	return out
-}
-
-func ParseReceived(rawResponse []byte) (ServerRequest, error) {
-	if rawResponse[0] != receivedResponseTag {
-		panic("Received invalid response!")
+	req, err := eternityProto.DecodeRequest(received.Message)
+	SR := ServerRequest{
+		SURB:   received.SURB,
+		ID:     req.ID,
+		Action: req.Action,
 	}
-
-	hasSurb := false
-	if rawResponse[1] == 1 {
-		hasSurb = true
-	} else if rawResponse[1] == 0 {
-		hasSurb = false
-	} else {
-		panic("malformed received response!")
+	if err != nil {
+		return SR, err
 	}
 
-	data := rawResponse[2:]
-	if hasSurb {
-		surbLen := binary.BigEndian.Uint64(data[:8])
-		other := data[8:]
-
-		surb := other[:surbLen]
-		msgLen := binary.BigEndian.Uint64(other[surbLen : surbLen+8])
-
-		if len(other[surbLen+8:]) != int(msgLen) {
-			panic("invalid msg len")
-		}
-
-		msg := other[surbLen+8:]
-		actionByte := msg[0]
-		SR := &ServerRequest{
-			SURB: surb,
-		}
-		msg = msg[1:]
-		switch actionByte {
-		case 0x00: // search
-		case 0x01: // store
-			// pubByte := msg[0] // if the pubByte = 0, this is a public file
-			msg = msg[1:]
-			publicKey := msg[:32] // 32 byte ED25519 public key
-			fileSig := msg[32:96] // 64 byte ED25519 signature of file
-			fileBody := msg[96:]  // file body
-
-			SR.Action = actionByte
-			SR.FileSig = fileSig
-			SR.PubKey = publicKey
-			SR.Body = fileBody
-		case 0x02: // serve
-		case 0x03: // delete
-		}
-		var clientRequest RawRequest
-		err := json.Unmarshal(msg, clientRequest)
+	SR.Hash = req.Get(eternityProto.FieldHash)
+	SR.PubKey = req.Get(eternityProto.FieldPublicKey)
+	SR.FileSig = req.Get(eternityProto.FieldSignature)
+	SR.Body = req.Get(eternityProto.FieldBody)
+	SR.Manifest = req.Get(eternityProto.FieldManifest)
+	if index := req.Get(eternityProto.FieldIndex); index != nil {
+		SR.Index = eternityProto.DecodeIndex(index)
+	}
+	if timestamp := req.Get(eternityProto.FieldTimestamp); timestamp != nil {
+		SR.Timestamp = eternityProto.DecodeTimestamp(timestamp)
+	}
+	if visibility := req.Get(eternityProto.FieldVisibility); visibility != nil {
+		v, err := eternityProto.DecodeVisibility(visibility)
 		if err != nil {
-
+			return SR, err
 		}
-
-		return *SR, nil
-	} else {
-		return ServerRequest{}, &InvalidRequestError{}
+		SR.Private = v == eternityProto.VisibilityPrivate
 	}
+
+	return SR, nil
 }
 
 func GetSelfAddress(conn *websocket.Conn) string {
@@ -0,0 +1,38 @@
+package nymLib
+
+import (
+	"eternity/eternityProto"
+	"eternity/nymProto"
+	"testing"
+)
+
+func FuzzParseReceived(f *testing.F) {
+	hash := make([]byte, eternityProto.HashLength)
+	surb := []byte("a reply block")
+	f.Add(nymProto.MakeReceived(eternityProto.NewSearchRequest(1, hash).Encode(), surb))
+	f.Add(nymProto.MakeReceived(eternityProto.NewServeChunkRequest(2, hash, 3).Encode(), surb))
+	f.Add(nymProto.MakeReceived(eternityProto.NewSearchRequest(1, hash).Encode(), nil))
+	f.Add(nymProto.MakeReceived([]byte("not eternity"), surb))
+	f.Add(nymProto.MakeError(nymProto.ErrorKindOther, "gateway went away"))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		sR, err := ParseReceived(raw)
+		if err != nil {
+			return
+		}
+		if sR.SURB == nil {
+			t.Fatalf("request parsed without a SURB to answer it with")
+		}
+		// whatever we parsed we must be able to answer
+		resp := eternityProto.NewResponse(eternityProto.Request{ID: sR.ID, Action: sR.Action}, eternityProto.StatusOK)
+		frame := sR.Reply(resp).Frame()
+		reply, err := nymProto.ParseReplyRequest(frame)
+		if err != nil {
+			t.Fatalf("reply frame does not parse: %v", err)
+		}
+		if string(reply.SURB) != string(sR.SURB) {
+			t.Fatalf("reply went to SURB %x, want %x", reply.SURB, sR.SURB)
+		}
+	})
+}
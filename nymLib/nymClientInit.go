@@ -0,0 +1,94 @@
+package nymLib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"eternity/nymProto"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+type NoAddressInOutputError struct{}
+
+func (e *NoAddressInOutputError) Error() string {
+	return "nym-client init did not print the address of the client"
+}
+
+// NymClientDir is where nym-client keeps the config and keys of a client
+// id
+func NymClientDir(id string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	return filepath.Join(home, ".nym", "clients", id)
+}
+
+// Initialised tells if nym-client init has been run for the client id
+func (opts NymClientOpts) Initialised() (bool, error) {
+	_, err := os.Stat(filepath.Join(NymClientDir(opts.ID), "config", "config.toml"))
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (opts NymClientOpts) initArgs() []string {
+	args := []string{"init", "--id", opts.ID, "--gateway", opts.Gateway}
+	if opts.Port != "" {
+		args = append(args, "--port", opts.Port)
+	}
+	return args
+}
+
+// InitNymClient runs nym-client init for the client id and returns the nym
+// address of the new client
+func InitNymClient(ctx context.Context, opts NymClientOpts) (string, error) {
+	log.Printf("initialising nym-client %s", opts.ID)
+	out, err := exec.CommandContext(ctx, opts.Binary, opts.initArgs()...).CombinedOutput()
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		log.Printf("nym-client init > %s", line)
+	}
+	if err != nil {
+		return "", fmt.Errorf("nym-client init: %w", err)
+	}
+	return addressFromInitOutput(out)
+}
+
+// addressFromInitOutput finds the address in what nym-client init prints,
+// "The address of this client is: <address>"
+func addressFromInitOutput(out []byte) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.Index(line, "address of this client is:")
+		if i < 0 {
+			continue
+		}
+		address := strings.TrimSpace(line[i+len("address of this client is:"):])
+		if _, err := nymProto.ParseRecipient(address); err != nil {
+			return "", err
+		}
+		return address, nil
+	}
+	return "", &NoAddressInOutputError{}
+}
+
+// EnsureNymClient runs nym-client init unless the client id already exists,
+// the address is returned when a new client was made
+func EnsureNymClient(ctx context.Context, opts NymClientOpts) (string, error) {
+	ok, err := opts.Initialised()
+	if err != nil || ok {
+		return "", err
+	}
+	return InitNymClient(ctx, opts)
+}
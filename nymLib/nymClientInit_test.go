@@ -0,0 +1,134 @@
+package nymLib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"eternity/nymProto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// what nym-client init prints to the address line
+const fakeNymInitOutputEnv = "ETERNITY_TEST_FAKE_NYM_INIT_OUTPUT"
+
+var testNymAddress = nymProto.FormatRecipient(bytes.Repeat([]byte{7}, nymProto.AddressLength))
+
+// initOutput is what nym-client init prints, ending with addressLine
+func initOutput(addressLine string) string {
+	return `
+      _ __  _   _ _ __ ___
+     | '_ \| | | | '_ \ _ \
+     | | | | |_| | | | | | |
+     |_| |_|\__, |_| |_| |_|
+            |___/
+
+             (client - version 0.12.1)
+
+Initialising client...
+Saved mixnet identity and encryption keys
+Saved configuration file to "/home/eternity/.nym/clients/test/config/config.toml"
+Using gateway: 6LdVTJhRfJKsrUtnjFqE3TpEbCYs3VZoxmaoNFqRWn4x
+Client configuration completed.
+
+` + addressLine + "\n"
+}
+
+func TestAddressFromInitOutput(t *testing.T) {
+	var noAddressErr *NoAddressInOutputError
+	var invalidErr *nymProto.InvalidAddressError
+
+	tests := []struct {
+		name    string
+		out     string
+		want    string
+		wantErr interface{}
+	}{
+		{"address line", initOutput("The address of this client is: " + testNymAddress), testNymAddress, nil},
+		{"windows line endings", strings.ReplaceAll(initOutput("The address of this client is: "+testNymAddress), "\n", "\r\n"), testNymAddress, nil},
+		{"log prefix", initOutput("2021-11-02T10:00:00Z INFO  nym_client > The address of this client is: " + testNymAddress), testNymAddress, nil},
+		{"no address line", initOutput("Client configuration completed."), "", &noAddressErr},
+		{"empty output", "", "", &noAddressErr},
+		{"address missing", initOutput("The address of this client is:"), "", &invalidErr},
+		{"address cut off", initOutput("The address of this client is: " + testNymAddress[:len(testNymAddress)/2]), "", &invalidErr},
+		{"address not base58", initOutput("The address of this client is: 0OIl.0OIl@0OIl"), "", &invalidErr},
+		{"text after the address", initOutput("The address of this client is: " + testNymAddress + " (saved)"), "", &invalidErr},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := addressFromInitOutput([]byte(tt.out))
+			if tt.wantErr == nil {
+				if err != nil || got != tt.want {
+					t.Fatalf("got %q, %v, want %q", got, err, tt.want)
+				}
+				return
+			}
+			if !errors.As(err, tt.wantErr) {
+				t.Fatalf("got %q, %v, want %T", got, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func testInitOpts(t *testing.T, mode string, output string) NymClientOpts {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(fakeNymClientEnv, mode)
+	t.Setenv(fakeNymInitOutputEnv, output)
+	return NymClientOpts{Binary: os.Args[0], ID: "test", Gateway: "test", Port: "1977"}
+}
+
+func TestInitNymClient(t *testing.T) {
+	opts := testInitOpts(t, "init", initOutput("The address of this client is: "+testNymAddress))
+	address, err := InitNymClient(context.Background(), opts)
+	if err != nil || address != testNymAddress {
+		t.Fatalf("InitNymClient: %q, %v", address, err)
+	}
+
+	opts = testInitOpts(t, "init", initOutput("Client configuration completed."))
+	var noAddressErr *NoAddressInOutputError
+	if _, err := InitNymClient(context.Background(), opts); !errors.As(err, &noAddressErr) {
+		t.Fatalf("InitNymClient without an address: %v, want NoAddressInOutputError", err)
+	}
+
+	opts = testInitOpts(t, "fail", "Error: gateway not found\n")
+	if _, err := InitNymClient(context.Background(), opts); err == nil || !strings.Contains(err.Error(), "nym-client init") {
+		t.Fatalf("InitNymClient exiting with an error: %v", err)
+	}
+
+	opts = testInitOpts(t, "init", "")
+	opts.Binary = filepath.Join(t.TempDir(), "nym-client")
+	if _, err := InitNymClient(context.Background(), opts); err == nil {
+		t.Fatalf("InitNymClient ran a missing binary")
+	}
+}
+
+func TestEnsureNymClient(t *testing.T) {
+	opts := testInitOpts(t, "init", initOutput("The address of this client is: "+testNymAddress))
+	if ok, err := opts.Initialised(); err != nil || ok {
+		t.Fatalf("Initialised before init: %v, %v", ok, err)
+	}
+	address, err := EnsureNymClient(context.Background(), opts)
+	if err != nil || address != testNymAddress {
+		t.Fatalf("EnsureNymClient: %q, %v", address, err)
+	}
+
+	// nym-client init writes the config, once it is there init is not run
+	config := filepath.Join(NymClientDir(opts.ID), "config", "config.toml")
+	if err := os.MkdirAll(filepath.Dir(config), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(config, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := opts.Initialised(); err != nil || !ok {
+		t.Fatalf("Initialised after init: %v, %v", ok, err)
+	}
+	t.Setenv(fakeNymClientEnv, "fail")
+	if address, err := EnsureNymClient(context.Background(), opts); err != nil || address != "" {
+		t.Fatalf("EnsureNymClient of an existing client: %q, %v", address, err)
+	}
+}
@@ -2,39 +2,381 @@ package nymLib
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net"
 	"os"
 	"os/exec"
+	"sync"
+	"time"
 )
 
-func StartEternityServerNymClientWatcher() {
-	cmd := exec.Command("nym/target/release/nym-client", "run", "--id", "eternClient", "--gateway", "6LdVTJhRfJKsrUtnjFqE3TpEbCYs3VZoxmaoNFqRWn4x")
+// DefaultNymPort is the websocket port nym-client listens on unless told
+// otherwise
+const DefaultNymPort = "1977"
 
-	// create a pipe for the output of the script
-	// TODO pipe stderr too
-	cmdReader, err := cmd.StdoutPipe()
+// NymClientOpts says how to run nym-client
+type NymClientOpts struct {
+	Binary  string   // path to the nym-client binary
+	ID      string   // id of an initialised nym-client
+	Gateway string   // identity key of the gateway to connect to
+	Port    string   // websocket port, the nym-client default if empty
+	Args    []string // extra arguments for nym-client run
+}
+
+func (opts NymClientOpts) runArgs() []string {
+	args := []string{"run", "--id", opts.ID, "--gateway", opts.Gateway}
+	if opts.Port != "" {
+		args = append(args, "--port", opts.Port)
+	}
+	return append(args, opts.Args...)
+}
+
+func (opts NymClientOpts) port() string {
+	if opts.Port == "" {
+		return DefaultNymPort
+	}
+	return opts.Port
+}
+
+type SupervisorState int
+
+const (
+	StateStarting   SupervisorState = iota // launched, websocket not up yet
+	StateReady                             // websocket port accepts connections
+	StateRestarting                        // crashed, waiting to launch again
+	StateFailed                            // crashed too often, given up
+	StateStopped                           // stopped through its context
+)
+
+func (s SupervisorState) String() string {
+	switch s {
+	case StateStarting:
+		return "starting"
+	case StateReady:
+		return "ready"
+	case StateRestarting:
+		return "restarting"
+	case StateFailed:
+		return "failed"
+	case StateStopped:
+		return "stopped"
+	}
+	return fmt.Sprintf("unknown state %d", int(s))
+}
+
+type SupervisorFailedError struct {
+	Restarts int
+	Err      error // why the last run ended
+}
+
+func (e *SupervisorFailedError) Error() string {
+	return fmt.Sprintf("nym-client failed %d times in a row, last error: %v", e.Restarts, e.Err)
+}
+
+func (e *SupervisorFailedError) Unwrap() error {
+	return e.Err
+}
+
+// NymClientUnresponsiveError is why a nym-client that is still running but
+// no longer answers on its websocket port was restarted
+type NymClientUnresponsiveError struct {
+	Failures int   // liveness checks failed in a row
+	Err      error // why the last one failed
+}
+
+func (e *NymClientUnresponsiveError) Error() string {
+	return fmt.Sprintf("nym-client failed %d liveness checks in a row, last error: %v", e.Failures, e.Err)
+}
+
+func (e *NymClientUnresponsiveError) Unwrap() error {
+	return e.Err
+}
+
+// backoff between restarts of a crashing nym-client, a run that lasts
+// stableRunTime resets it
+const minRestartWait = time.Second
+const maxRestartWait = time.Minute
+const stableRunTime = 5 * time.Minute
+
+// how long nym-client gets to exit after an interrupt before it is killed
+const nymStopTimeout = 10 * time.Second
+
+// how often we look at the websocket port while nym-client starts
+const readyPollInterval = 250 * time.Millisecond
+
+// once it is ready nym-client is checked every livenessInterval, after
+// livenessFailures failed checks in a row it is restarted
+const livenessInterval = 10 * time.Second
+const livenessFailures = 3
+
+// how long nym-client gets to answer one check
+const probeTimeout = 5 * time.Second
+
+// NymClientSupervisor keeps a nym-client process running, restarting it
+// with backoff when it exits
+type NymClientSupervisor struct {
+	Opts NymClientOpts
+
+	// consecutive crashes before giving up, 0 restarts forever
+	MaxRestarts int
+
+	// the intervals above, tests shorten them
+	readyPoll    time.Duration
+	liveness     time.Duration
+	probeTimeout time.Duration
+
+	mut     sync.Mutex
+	state   SupervisorState
+	lastErr error
+	changed chan struct{} // closed and replaced on every state change
+}
+
+func NewNymClientSupervisor(opts NymClientOpts) *NymClientSupervisor {
+	return &NymClientSupervisor{
+		Opts:         opts,
+		readyPoll:    readyPollInterval,
+		liveness:     livenessInterval,
+		probeTimeout: probeTimeout,
+		state:        StateStarting,
+		changed:      make(chan struct{}),
+	}
+}
+
+// State is what the supervised nym-client is doing right now
+func (s *NymClientSupervisor) State() SupervisorState {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.state
+}
+
+// Err is why nym-client last exited, nil if it has not
+func (s *NymClientSupervisor) Err() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.lastErr
+}
+
+// Changed is closed the next time the state changes
+func (s *NymClientSupervisor) Changed() <-chan struct{} {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.changed
+}
+
+func (s *NymClientSupervisor) setState(state SupervisorState, err error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error creating StdoutPipe for Cmd", err)
+		s.lastErr = err
+	}
+	if state == s.state {
 		return
 	}
+	log.Printf("nym-client %s", state)
+	s.state = state
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
 
-	scanner := bufio.NewScanner(cmdReader)
+// WaitReady waits until the websocket of nym-client accepts connections
+func (s *NymClientSupervisor) WaitReady(ctx context.Context) error {
+	for {
+		changed := s.Changed()
+		switch s.State() {
+		case StateReady:
+			return nil
+		case StateFailed:
+			return s.Err()
+		case StateStopped:
+			return context.Canceled
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Run launches nym-client and keeps it running until ctx is done, when
+// nym-client is stopped and nil returned. It returns a
+// SupervisorFailedError once MaxRestarts is exceeded.
+func (s *NymClientSupervisor) Run(ctx context.Context) error {
+	wait := minRestartWait
+	failures := 0
+	for {
+		s.setState(StateStarting, nil)
+		started := time.Now()
+		err := s.runOnce(ctx)
+		if ctx.Err() != nil {
+			s.setState(StateStopped, nil)
+			return nil
+		}
+		if err == nil {
+			err = fmt.Errorf("nym-client exited")
+		}
+		log.Printf("nym-client stopped: %v", err)
+
+		if time.Since(started) > stableRunTime {
+			failures = 0
+			wait = minRestartWait
+		}
+		failures++
+		if s.MaxRestarts > 0 && failures > s.MaxRestarts {
+			err = &SupervisorFailedError{Restarts: failures, Err: err}
+			s.setState(StateFailed, err)
+			return err
+		}
+
+		s.setState(StateRestarting, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			s.setState(StateStopped, nil)
+			return nil
+		}
+		wait *= 2
+		if wait > maxRestartWait {
+			wait = maxRestartWait
+		}
+	}
+}
+
+// runOnce runs nym-client until it exits or ctx is done
+func (s *NymClientSupervisor) runOnce(ctx context.Context) error {
+	cmd := exec.Command(s.Opts.Binary, s.Opts.runArgs()...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// the pipes have to be read empty before Wait closes them
+	var output sync.WaitGroup
+	output.Add(2)
+	go logOutput(&output, "stdout", stdout)
+	go logOutput(&output, "stderr", stderr)
+
+	exited := make(chan struct{})
+	unresponsive := make(chan error, 1)
+	go s.watchHealth(cmd.Process, exited, unresponsive)
 	go func() {
-		for scanner.Scan() {
-			fmt.Printf("\t > %s\n", scanner.Text())
+		select {
+		case <-ctx.Done():
+			stopProcess(cmd.Process, exited)
+		case <-exited:
 		}
 	}()
 
-	err = cmd.Start()
-	// if err != nil {
-	// 	fmt.Fprintln(os.Stderr, "Error starting Cmd", err)
-	// 	return
-	// }
-
+	output.Wait()
 	err = cmd.Wait()
-	// if err != nil {
-	// 	fmt.Fprintln(os.Stderr, "Error waiting for Cmd", err)
-	// 	return
-	// }
+	close(exited)
+	select {
+	case healthErr := <-unresponsive:
+		// we stopped it, say why
+		return healthErr
+	default:
+		return err
+	}
+}
+
+func logOutput(wg *sync.WaitGroup, name string, r io.Reader) {
+	defer wg.Done()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		log.Printf("nym-client %s > %s", name, scanner.Text())
+	}
+}
 
+// watchHealth marks nym-client ready once its websocket port answers and
+// keeps checking it from then on. A nym-client that stops answering is
+// stopped, with the reason sent on unresponsive, so Run starts it again.
+func (s *NymClientSupervisor) watchHealth(p *os.Process, exited <-chan struct{}, unresponsive chan<- error) {
+	addr := net.JoinHostPort("localhost", s.Opts.port())
+	interval := s.readyPoll
+	ready := false
+	failures := 0
+	for {
+		select {
+		case <-exited:
+			return
+		case <-time.After(interval):
+		}
+
+		err := probe(addr, s.probeTimeout)
+		if !ready {
+			if err != nil {
+				continue
+			}
+			ready = true
+			interval = s.liveness
+			select {
+			case <-exited:
+				return
+			default:
+				s.setState(StateReady, nil)
+			}
+			continue
+		}
+
+		if err == nil {
+			failures = 0
+			continue
+		}
+		failures++
+		log.Printf("nym-client liveness check failed: %v", err)
+		if failures < livenessFailures {
+			continue
+		}
+		err = &NymClientUnresponsiveError{Failures: failures, Err: err}
+		unresponsive <- err
+		s.setState(StateRestarting, err)
+		stopProcess(p, exited)
+		return
+	}
+}
+
+// probe checks that nym-client answers on addr. A process that hangs still
+// has the kernel accept connections for it, so we send a plain HTTP request
+// and wait for any answer. Not being a websocket upgrade it never takes the
+// websocket from the server, nym-client refuses it and closes the
+// connection, which is answer enough.
+func probe(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"); err != nil {
+		return err
+	}
+	// data, a closed or a reset connection all come from a live process
+	_, err = conn.Read(make([]byte, 1))
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return err
+	}
+	return nil
+}
+
+// stopProcess interrupts nym-client and kills it if it is still around
+// after nymStopTimeout
+func stopProcess(p *os.Process, exited <-chan struct{}) {
+	p.Signal(os.Interrupt)
+	select {
+	case <-exited:
+	case <-time.After(nymStopTimeout):
+		p.Kill()
+	}
 }
@@ -0,0 +1,142 @@
+package nymLib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// set in the environment of the test binary when it is run as nym-client
+const fakeNymClientEnv = "ETERNITY_TEST_FAKE_NYM_CLIENT"
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(fakeNymClientEnv); mode != "" {
+		runFakeNymClient(mode, os.Args[1:])
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runFakeNymClient listens on the --port it is given like nym-client run.
+// In "hang" mode it answers the first check and then accepts connections
+// without ever answering, like a process that got stuck. init prints
+// fakeNymInitOutputEnv and fails in "fail" mode.
+func runFakeNymClient(mode string, args []string) {
+	if len(args) > 0 && args[0] == "init" {
+		fmt.Print(os.Getenv(fakeNymInitOutputEnv))
+		if mode == "fail" {
+			os.Exit(1)
+		}
+		return
+	}
+	port := DefaultNymPort
+	for i, arg := range args {
+		if arg == "--port" && i+1 < len(args) {
+			port = args[i+1]
+		}
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		os.Exit(1)
+	}
+	for answered := 0; ; answered++ {
+		conn, err := l.Accept()
+		if err != nil {
+			os.Exit(1)
+		}
+		if mode == "hang" && answered > 0 {
+			defer conn.Close()
+			continue
+		}
+		conn.Close()
+	}
+}
+
+func freePort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+func testSupervisor(t *testing.T, mode string) *NymClientSupervisor {
+	t.Setenv(fakeNymClientEnv, mode)
+	s := NewNymClientSupervisor(NymClientOpts{
+		Binary:  os.Args[0],
+		ID:      "test",
+		Gateway: "test",
+		Port:    freePort(t),
+	})
+	s.readyPoll = 20 * time.Millisecond
+	s.liveness = 20 * time.Millisecond
+	s.probeTimeout = 100 * time.Millisecond
+	return s
+}
+
+// waitState waits until the supervisor reaches state
+func waitState(t *testing.T, s *NymClientSupervisor, state SupervisorState) {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		changed := s.Changed()
+		if s.State() == state {
+			return
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatalf("supervisor is %s, waited for %s", s.State(), state)
+		}
+	}
+}
+
+func runSupervisor(t *testing.T, s *NymClientSupervisor) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestSupervisorStaysReady(t *testing.T) {
+	s := testSupervisor(t, "answer")
+	runSupervisor(t, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady: %v", err)
+	}
+	// plenty of liveness checks
+	time.Sleep(20 * s.liveness)
+	if state := s.State(); state != StateReady {
+		t.Fatalf("healthy nym-client went %s: %v", state, s.Err())
+	}
+}
+
+func TestSupervisorRestartsHungClient(t *testing.T) {
+	s := testSupervisor(t, "hang")
+	runSupervisor(t, s)
+
+	waitState(t, s, StateReady)
+	waitState(t, s, StateRestarting)
+	var unresponsiveErr *NymClientUnresponsiveError
+	if err := s.Err(); !errors.As(err, &unresponsiveErr) {
+		t.Fatalf("restarted because of %v, want an unresponsive nym-client", err)
+	}
+	// the new process answers its first check
+	waitState(t, s, StateReady)
+}
@@ -1,153 +1,621 @@
 package nymLib
 
 import (
-	"encoding/binary"
+	"context"
+	"encoding/base64"
+	"errors"
 	"eternity/eternityFS"
+	"eternity/eternityProto"
+	"eternity/nymProto"
+	"log"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-// const sendRequestTag = 0x00
-// const replyRequestTag = 0x01
-// const selfAddressRequestTag = 0x02
-
-// // response tags
-// const errorResponseTag = 0x00
-// const receivedResponseTag = 0x01
-// const selfAddressResponseTag = 0x02
-
-type RawRequest struct {
-	Action  []byte `json:"action"`
-	Payload []byte `json:"payload"`
-}
-
 type ServerRequest struct {
-	SURB    []byte
-	Action  byte
-	FileSig []byte
-	PubKey  []byte
-	Body    []byte
+	SURB     []byte
+	ID       uint64
+	Action   eternityProto.Action
+	Hash     []byte // raw SHA256 hash of the file the request is about
+	FileSig  []byte
+	PubKey   []byte
+	Body     []byte
+	Manifest []byte // encoded manifest for chunked uploads
+	Index    uint32 // chunk index for chunked transfers
+	Private  bool   // store the file for its owner only
+
+	Timestamp time.Time // when a delete was signed
 }
 
+// ServerResponse is an encoded eternity response and the SURB that carries
+// it back to whoever sent the request
 type ServerResponse struct {
 	SURB    []byte
 	Message []byte
 }
 
+// Reply builds the response to the request, carried by its SURB
+func (sR ServerRequest) Reply(resp eternityProto.Response) ServerResponse {
+	return ServerResponse{
+		SURB:    sR.SURB,
+		Message: resp.Encode(),
+	}
+}
+
+// Frame is the nym reply frame that sends the response
+func (r ServerResponse) Frame() []byte {
+	return nymProto.MakeReplyRequest(r.Message, r.SURB)
+}
+
 type WebSocketHandler struct {
-	writeMut      sync.Mutex // mutex for writing to the connection
+	writeMut      sync.Mutex // guards Conn and writing to it
 	Conn          *websocket.Conn
 	RequestQueue  chan ServerRequest
 	ResponseQueue chan ServerResponse
 	Efs           eternityFS.EternityFS
+	Workers       int // requests handled at once
+
+	// Dial opens a new connection to nym-client when the current one drops,
+	// without it the handler stops when the connection is lost
+	Dial func() (*websocket.Conn, error)
+
+	connChanged chan struct{} // closed and replaced whenever Conn is replaced
+	connBroken  chan struct{} // closed when a write to Conn fails
+	selfAddress []byte        // our nym address as told by nym-client
+
+	stopOnce sync.Once
+	stopping chan struct{} // closed when shutdown begins
+	done     chan struct{} // closed once shutdown has finished
+	err      error         // why the reader stopped, nil if we stopped it
+	saveErr  error
+}
+
+// statusForError picks the status sent to the client for a failed request
+func statusForError(err error) eternityProto.Status {
+	var keyErr *eternityFS.InvalidPublicKeyError
+	var sigErr *eternityFS.InvalidSignatureError
+	var notFoundErr *eternityFS.FileNotFoundError
+	var ownerErr *eternityFS.NoOwnerKeyError
+	var versionErr *eternityProto.UnsupportedVersionError
+	var actionErr *eternityProto.UnknownActionError
+	var missingErr *eternityProto.MissingFieldError
+	var lengthErr *eternityProto.FieldLengthError
+	var duplicateErr *eternityProto.DuplicateFieldError
+	var truncatedErr *eternityProto.TruncatedFrameError
+	var manifestErr *eternityProto.InvalidManifestError
+	var chunkErr *eternityProto.ChunkHashMismatchError
+	var uploadErr *eternityFS.UploadNotFoundError
+	var ownedErr *eternityFS.FileOwnedError
+	var visibilityErr *eternityProto.UnknownVisibilityError
+	var staleErr *eternityFS.StaleDeleteError
+	var tooLargeErr *eternityFS.FileTooLargeError
+	switch {
+	case errors.As(err, &keyErr):
+		return eternityProto.StatusBadPublicKey
+	case errors.As(err, &sigErr), errors.As(err, &staleErr):
+		return eternityProto.StatusBadSignature
+	case errors.As(err, &notFoundErr), errors.As(err, &uploadErr):
+		return eternityProto.StatusNotFound
+	case errors.As(err, &ownedErr):
+		return eternityProto.StatusConflict
+	case errors.As(err, &ownerErr):
+		return eternityProto.StatusNoOwnerKey
+	case errors.As(err, &versionErr):
+		return eternityProto.StatusUnsupportedVersion
+	case errors.As(err, &actionErr), errors.As(err, &missingErr), errors.As(err, &lengthErr),
+		errors.As(err, &duplicateErr), errors.As(err, &truncatedErr), errors.As(err, &manifestErr),
+		errors.As(err, &chunkErr), errors.As(err, &visibilityErr), errors.As(err, &tooLargeErr):
+		return eternityProto.StatusBadRequest
+	}
+	return eternityProto.StatusInternalError
+}
+
+// errorResponse builds the response for a failed request, the status
+// followed by a human readable message
+func errorResponse(req eternityProto.Request, err error) eternityProto.Response {
+	return eternityProto.NewResponse(req, statusForError(err)).
+		Set(eternityProto.FieldError, []byte(err.Error()))
 }
 
 func saveFile(message []byte) {}
 
 func sendFile(fileData []byte, recipient []byte) {}
 
-func MakeReplyRequest(message []byte, replySURB []byte) []byte {
-	messageLen := make([]byte, 8)
-	binary.BigEndian.PutUint64(messageLen, uint64(len(message)))
+// how often uploads that timed out are removed from the staging area
+const uploadCollectInterval = 10 * time.Minute
+
+// DefaultWorkers is how many requests are handled at once unless Workers is
+// set
+const DefaultWorkers = 16
 
-	surbLen := make([]byte, 8)
-	binary.BigEndian.PutUint64(surbLen, uint64(len(replySURB)))
+// how long we wait on nym-client to take a frame
+const writeTimeout = 10 * time.Second
 
-	out := []byte{replyRequestTag}
-	out = append(out, surbLen...)
-	out = append(out, replySURB...)
-	out = append(out, messageLen...)
-	out = append(out, message...)
+// backoff between attempts to reconnect to nym-client
+const minReconnectWait = 500 * time.Millisecond
+const maxReconnectWait = 30 * time.Second
 
-	return out
+// how many connections a response is tried on before it is dropped
+const maxSendAttempts = 5
+
+// DialNymClient returns a Dial func for the nym-client websocket at uri
+func DialNymClient(uri string) func() (*websocket.Conn, error) {
+	return func() (*websocket.Conn, error) {
+		conn, _, err := websocket.DefaultDialer.Dial(uri, nil)
+		return conn, err
+	}
 }
 
-func NewWebsocketHandler(conn *websocket.Conn) *WebSocketHandler {
-	efs, err := eternityFS.InitEFS("/Users/orchid/eternity")
+// NewWebsocketHandler serves the eternityFS in dataDir over conn
+func NewWebsocketHandler(conn *websocket.Conn, dataDir string) (*WebSocketHandler, error) {
+	efs, err := eternityFS.InitEFS(dataDir)
 
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	return NewEFSHandler(conn, efs), nil
+}
 
-	wsh := &WebSocketHandler{
+// NewEFSHandler serves an eternityFS that is already open over conn
+func NewEFSHandler(conn *websocket.Conn, efs eternityFS.EternityFS) *WebSocketHandler {
+	return &WebSocketHandler{
 		Conn:          conn,
 		Efs:           efs,
 		RequestQueue:  make(chan ServerRequest, 50),
 		ResponseQueue: make(chan ServerResponse, 50),
+		Workers:       DefaultWorkers,
+		connChanged:   make(chan struct{}),
+		connBroken:    make(chan struct{}),
+		stopping:      make(chan struct{}),
+		done:          make(chan struct{}),
 	}
-	return wsh
 }
-func (wsh *WebSocketHandler) ReaderRoutine() {
+
+// Start runs the handler until ctx is cancelled, Stop is called or the
+// connection to nym-client fails. On the way down queued requests are still
+// answered, then the config is saved and the connection closed, after which
+// Done is closed.
+func (wsh *WebSocketHandler) Start(ctx context.Context) {
+	collectorStop := make(chan struct{})
+	go wsh.Efs.RunUploadCollector(uploadCollectInterval, collectorStop)
+	if err := wsh.requestSelfAddress(); err != nil {
+		log.Printf("asking nym-client for our address failed: %v", err)
+	}
+
+	responsesDone := make(chan struct{})
+	go func() {
+		wsh.ResponseProcessor()
+		close(responsesDone)
+	}()
+	go wsh.RequestProcessor()
+	go func() {
+		if err := wsh.ReaderRoutine(); err != nil {
+			log.Printf("reading from nym-client failed: %v", err)
+			wsh.err = err
+		}
+		close(wsh.RequestQueue)
+	}()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			wsh.shutdown()
+		case <-wsh.done:
+		}
+	}()
+	go func() {
+		<-responsesDone
+		close(collectorStop)
+		if err := wsh.Efs.SaveConfig(); err != nil {
+			log.Printf("saving config failed: %v", err)
+			wsh.saveErr = err
+		}
+		wsh.closeConn()
+		close(wsh.done)
+	}()
 }
 
-func (wsh *WebSocketHandler) RequestProcessor() {
-	println("starting request processor")
+// Stop shuts the handler down and waits until it has finished or ctx is done
+func (wsh *WebSocketHandler) Stop(ctx context.Context) error {
+	wsh.shutdown()
+	select {
+	case <-wsh.done:
+		return wsh.saveErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Done is closed once the handler has shut down
+func (wsh *WebSocketHandler) Done() <-chan struct{} {
+	return wsh.done
+}
+
+// Err is the error that made the handler stop, it is nil if the handler was
+// stopped through its context or Stop. Only valid once Done is closed.
+func (wsh *WebSocketHandler) Err() error {
+	return wsh.err
+}
+
+// SelfAddress is our binary nym address, nil until nym-client has told us
+func (wsh *WebSocketHandler) SelfAddress() []byte {
+	wsh.writeMut.Lock()
+	defer wsh.writeMut.Unlock()
+	return wsh.selfAddress
+}
+
+func (wsh *WebSocketHandler) shutdown() {
+	wsh.stopOnce.Do(func() {
+		wsh.writeMut.Lock()
+		defer wsh.writeMut.Unlock()
+		close(wsh.stopping)
+		// wakes the reader up, responses can still be written
+		wsh.Conn.SetReadDeadline(time.Now())
+	})
+}
+
+func (wsh *WebSocketHandler) closeConn() {
+	wsh.writeMut.Lock()
+	defer wsh.writeMut.Unlock()
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	wsh.Conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(writeTimeout))
+	wsh.Conn.Close()
+}
+
+// currentConn returns the connection in use and a channel that is closed
+// once it has been replaced
+func (wsh *WebSocketHandler) currentConn() (*websocket.Conn, <-chan struct{}) {
+	wsh.writeMut.Lock()
+	defer wsh.writeMut.Unlock()
+	return wsh.Conn, wsh.connChanged
+}
+
+// brokenConn returns a channel that is closed once a write to the current
+// connection has failed
+func (wsh *WebSocketHandler) brokenConn() <-chan struct{} {
+	wsh.writeMut.Lock()
+	defer wsh.writeMut.Unlock()
+	return wsh.connBroken
+}
+
+// setConn replaces the connection, it refuses once we are shutting down
+func (wsh *WebSocketHandler) setConn(conn *websocket.Conn) bool {
+	wsh.writeMut.Lock()
+	defer wsh.writeMut.Unlock()
+	select {
+	case <-wsh.stopping:
+		return false
+	default:
+	}
+
+	wsh.Conn.Close()
+	wsh.Conn = conn
+	wsh.selfAddress = nil
+	close(wsh.connChanged)
+	wsh.connChanged = make(chan struct{})
+	wsh.connBroken = make(chan struct{})
+	return true
+}
+
+// reconnect dials nym-client until it succeeds or the handler is stopped,
+// waiting twice as long after every failed attempt
+func (wsh *WebSocketHandler) reconnect() bool {
+	wait := minReconnectWait
 	for {
-		for request := range wsh.RequestQueue {
-			go wsh.HandleRequest(request)
+		select {
+		case <-wsh.stopping:
+			return false
+		case <-time.After(wait):
 		}
+
+		conn, err := wsh.Dial()
+		if err != nil {
+			wait *= 2
+			if wait > maxReconnectWait {
+				wait = maxReconnectWait
+			}
+			log.Printf("reconnecting to nym-client failed, trying again in %s: %v", wait, err)
+			continue
+		}
+		if !wsh.setConn(conn) {
+			conn.Close()
+			return false
+		}
+		log.Printf("reconnected to nym-client")
+		if err := wsh.requestSelfAddress(); err != nil {
+			log.Printf("asking nym-client for our address failed: %v", err)
+		}
+		return true
 	}
 }
 
-func (wsh *WebSocketHandler) HandleRequest(sR ServerRequest) {
-	switch sR.Action {
-	case 0x00: // search
-		hash := string(sR.Body)
-		response := &ServerResponse{
-			SURB: sR.SURB,
+func (wsh *WebSocketHandler) requestSelfAddress() error {
+	return wsh.writeFrame(nymProto.MakeSelfAddressRequest())
+}
+
+// writeFrame writes one frame to nym-client. A failed write leaves the
+// connection unusable so it is closed, which makes the reader reconnect.
+func (wsh *WebSocketHandler) writeFrame(frame []byte) error {
+	wsh.writeMut.Lock()
+	defer wsh.writeMut.Unlock()
+	wsh.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := wsh.Conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		wsh.Conn.Close()
+		select {
+		case <-wsh.connBroken:
+		default:
+			close(wsh.connBroken)
 		}
-		if wsh.Efs.Search(hash) {
-			response.Message = []byte("file found")
-		} else {
-			response.Message = []byte("file not found")
-		}
-		wsh.ResponseQueue <- *response
-	case 0x01: // store
-		wsh.Efs.Store(sR.Body, sR.PubKey, sR.FileSig)
-	case 0x02: // serve
-		hash := string(sR.Body)
-		response := &ServerResponse{
-			SURB: sR.SURB,
-		}
-		file, err := wsh.Efs.GetFile(hash)
-		out := make([]byte, 0)
+		return err
+	}
+	return nil
+}
+
+// ReaderRoutine reads frames from the nym client and queues the requests in
+// them. A dropped connection is replaced using Dial, it returns when that is
+// not possible or, with a nil error, when the handler is shutting down
+func (wsh *WebSocketHandler) ReaderRoutine() error {
+	for {
+		conn, _ := wsh.currentConn()
+		_, receivedResponse, err := conn.ReadMessage()
 		if err != nil {
-			out = append(out, 0x00)
-		} else {
-			out = append(out, 0x01)
-			out = append(out, file...)
-			response.Message = out
+			select {
+			case <-wsh.stopping:
+				return nil
+			default:
+			}
+			if wsh.Dial == nil {
+				return err
+			}
+			log.Printf("lost connection to nym-client: %v", err)
+			if !wsh.reconnect() {
+				return nil
+			}
+			continue
+		}
+
+		if len(receivedResponse) > 0 && receivedResponse[0] == nymProto.SelfAddressResponseTag {
+			address, err := nymProto.ParseSelfAddress(receivedResponse)
+			if err != nil {
+				log.Printf("bad self address from nym-client: %v", err)
+				continue
+			}
+			wsh.writeMut.Lock()
+			wsh.selfAddress = address
+			wsh.writeMut.Unlock()
+			log.Printf("our nym address is %s", nymProto.FormatRecipient(address))
+			if err := wsh.Efs.SetNymAddress(nymProto.FormatRecipient(address)); err != nil {
+				log.Printf("saving our nym address failed: %v", err)
+			}
+			continue
 		}
 
-		wsh.ResponseQueue <- *response
-	case 0x03: // delete
+		request, err := ParseReceived(receivedResponse)
+		if err != nil {
+			var nymErr *nymProto.NymClientError
+			if errors.As(err, &nymErr) {
+				log.Printf("nym-client reported an error: %v", nymErr)
+				continue
+			}
+			log.Printf("dropping malformed request: %v", err)
+			if request.SURB != nil && !wsh.RejectRequest(request, err) {
+				return nil
+			}
+			continue
+		}
+		if !wsh.queueRequest(request) {
+			return nil
+		}
 	}
 }
 
-func (wsh *WebSocketHandler) ResponseProcessor() {
+// queueRequest hands a request to the workers. If a response can't be
+// written while we wait, the workers are stuck behind it until we have
+// reconnected, so we do that first. It returns false if we are shutting
+// down instead.
+func (wsh *WebSocketHandler) queueRequest(request ServerRequest) bool {
+	if wsh.Dial == nil {
+		// failed responses are dropped, the workers keep going
+		wsh.RequestQueue <- request
+		return true
+	}
 	for {
-		for response := range wsh.ResponseQueue {
-			wsh.SendResponse(response.SURB, response.Message)
+		select {
+		case wsh.RequestQueue <- request:
+			return true
+		case <-wsh.brokenConn():
+			log.Printf("lost connection to nym-client while queueing a request")
+			if !wsh.reconnect() {
+				return false
+			}
 		}
 	}
 }
 
-func (wsh *WebSocketHandler) SendResponse(message []byte, replySURB []byte) {
-	messageLen := make([]byte, 8)
-	binary.BigEndian.PutUint64(messageLen, uint64(len(message)))
+// RejectRequest answers a request that could not be handled with the error.
+// It is called by the reader, which like in queueRequest must not wait on a
+// full response queue behind a broken connection, only it can reconnect. It
+// returns false if we are shutting down instead.
+func (wsh *WebSocketHandler) RejectRequest(sR ServerRequest, err error) bool {
+	req := eternityProto.Request{ID: sR.ID, Action: sR.Action}
+	response := sR.Reply(errorResponse(req, err))
+	if wsh.Dial == nil {
+		wsh.ResponseQueue <- response
+		return true
+	}
+	for {
+		select {
+		case wsh.ResponseQueue <- response:
+			return true
+		case <-wsh.brokenConn():
+			log.Printf("lost connection to nym-client while rejecting a request")
+			if !wsh.reconnect() {
+				return false
+			}
+		}
+	}
+}
+
+// RequestProcessor handles requests with Workers goroutines until
+// RequestQueue is closed and drained, then closes ResponseQueue
+func (wsh *WebSocketHandler) RequestProcessor() {
+	workers := wsh.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
 
-	surbLen := make([]byte, 8)
-	binary.BigEndian.PutUint64(surbLen, uint64(len(replySURB)))
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for request := range wsh.RequestQueue {
+				wsh.HandleRequest(request)
+			}
+		}()
+	}
+	wg.Wait()
+	close(wsh.ResponseQueue)
+}
 
-	out := []byte{replyRequestTag}
-	out = append(out, surbLen...)
-	out = append(out, replySURB...)
-	out = append(out, messageLen...)
-	out = append(out, message...)
+func (wsh *WebSocketHandler) HandleRequest(sR ServerRequest) {
+	req := eternityProto.Request{ID: sR.ID, Action: sR.Action}
+	hash := base64.StdEncoding.EncodeToString(sR.Hash)
 
-	if err := wsh.Conn.WriteMessage(websocket.BinaryMessage, out); err != nil {
-		panic(err)
+	var resp eternityProto.Response
+	switch sR.Action {
+	case eternityProto.ActionSearch:
+		if wsh.Efs.Authorize(hash, sR.FileSig) == nil {
+			resp = eternityProto.NewResponse(req, eternityProto.StatusOK)
+		} else {
+			resp = eternityProto.NewResponse(req, eternityProto.StatusNotFound)
+		}
+	case eternityProto.ActionStore:
+		storedHash, err := wsh.Efs.Store(sR.Body, sR.PubKey, sR.FileSig, sR.Private)
+		if err != nil {
+			resp = errorResponse(req, err)
+			break
+		}
+		rawHash, _ := base64.StdEncoding.DecodeString(storedHash)
+		resp = eternityProto.NewResponse(req, eternityProto.StatusOK).
+			Set(eternityProto.FieldHash, rawHash)
+	case eternityProto.ActionServe:
+		if err := wsh.Efs.Authorize(hash, sR.FileSig); err != nil {
+			resp = errorResponse(req, err)
+			break
+		}
+		file, err := wsh.Efs.GetFileUpTo(hash, eternityProto.MaxServeSize)
+		if err != nil {
+			resp = errorResponse(req, err)
+			break
+		}
+		resp = eternityProto.NewResponse(req, eternityProto.StatusOK).
+			Set(eternityProto.FieldBody, file)
+	case eternityProto.ActionDelete:
+		if err := wsh.Efs.Delete(hash, sR.FileSig, sR.Timestamp); err != nil {
+			resp = errorResponse(req, err)
+			break
+		}
+		resp = eternityProto.NewResponse(req, eternityProto.StatusOK)
+	case eternityProto.ActionStoreManifest:
+		m, err := eternityProto.DecodeManifest(sR.Manifest)
+		if err != nil {
+			resp = errorResponse(req, err)
+			break
+		}
+		missing, err := wsh.Efs.BeginUpload(m, sR.PubKey, sR.FileSig, sR.Private)
+		if err != nil {
+			resp = errorResponse(req, err)
+			break
+		}
+		resp = eternityProto.NewResponse(req, eternityProto.StatusOK).
+			Set(eternityProto.FieldMissing, eternityProto.EncodeIndexes(missing))
+	case eternityProto.ActionStoreChunk:
+		missing, err := wsh.Efs.StoreChunk(hash, sR.PubKey, sR.Index, sR.Body, sR.FileSig)
+		if err != nil {
+			resp = errorResponse(req, err)
+			break
+		}
+		resp = eternityProto.NewResponse(req, eternityProto.StatusOK).
+			Set(eternityProto.FieldMissing, eternityProto.EncodeIndexes(missing))
+		if len(missing) == 0 {
+			resp = resp.Set(eternityProto.FieldHash, sR.Hash)
+		}
+	case eternityProto.ActionUploadStatus:
+		missing, err := wsh.Efs.UploadStatus(hash, sR.PubKey, sR.FileSig)
+		if err != nil {
+			resp = errorResponse(req, err)
+			break
+		}
+		resp = eternityProto.NewResponse(req, eternityProto.StatusOK).
+			Set(eternityProto.FieldMissing, eternityProto.EncodeIndexes(missing))
+	case eternityProto.ActionServeManifest:
+		if err := wsh.Efs.Authorize(hash, sR.FileSig); err != nil {
+			resp = errorResponse(req, err)
+			break
+		}
+		m, err := wsh.Efs.Manifest(hash)
+		if err != nil {
+			resp = errorResponse(req, err)
+			break
+		}
+		resp = eternityProto.NewResponse(req, eternityProto.StatusOK).
+			Set(eternityProto.FieldManifest, m.Encode())
+	case eternityProto.ActionServeChunk:
+		if err := wsh.Efs.Authorize(hash, sR.FileSig); err != nil {
+			resp = errorResponse(req, err)
+			break
+		}
+		chunk, err := wsh.Efs.GetChunk(hash, sR.Index)
+		if err != nil {
+			resp = errorResponse(req, err)
+			break
+		}
+		resp = eternityProto.NewResponse(req, eternityProto.StatusOK).
+			Set(eternityProto.FieldBody, chunk)
+	default:
+		resp = errorResponse(req, &eternityProto.UnknownActionError{Action: sR.Action})
+	}
+
+	wsh.ResponseQueue <- sR.Reply(resp)
+}
+
+// ResponseProcessor sends responses until ResponseQueue is closed and
+// drained
+func (wsh *WebSocketHandler) ResponseProcessor() {
+	for response := range wsh.ResponseQueue {
+		wsh.deliver(response)
 	}
+}
+
+// deliver sends a response. A SURB can only be used once, but when the
+// write fails nym-client never saw it, so the response is sent again once
+// we have reconnected. Responses queued behind it wait their turn.
+func (wsh *WebSocketHandler) deliver(response ServerResponse) {
+	for attempt := 1; ; attempt++ {
+		_, changed := wsh.currentConn()
+		err := wsh.SendResponse(response)
+		if err == nil {
+			return
+		}
+		if wsh.Dial == nil || attempt == maxSendAttempts {
+			log.Printf("dropping response after %d attempts: %v", attempt, err)
+			return
+		}
+		log.Printf("sending response failed, retrying once reconnected: %v", err)
+
+		select {
+		case <-changed:
+		case <-wsh.stopping:
+			log.Printf("dropping response, shutting down: %v", err)
+			return
+		}
+	}
+}
 
+// SendResponse writes the reply frame for the response to nym-client
+func (wsh *WebSocketHandler) SendResponse(response ServerResponse) error {
+	return wsh.writeFrame(response.Frame())
 }
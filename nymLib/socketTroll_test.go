@@ -0,0 +1,348 @@
+package nymLib
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"eternity/eternityFS"
+	"eternity/eternityProto"
+	"eternity/fakeNym"
+	"eternity/nymProto"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// a reader waiting for busy workers must notice that a response could not
+// be written, the workers wait for it to reconnect
+func TestQueueRequestReconnectsOnFailedWrite(t *testing.T) {
+	mixnet := fakeNym.NewMixnet()
+	nymClient, err := mixnet.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nymClient.Close()
+	conn, err := nymClient.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	efs, err := eternityFS.InitEFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wsh := NewEFSHandler(conn, efs)
+	wsh.Dial = nymClient.Dial
+	// nobody takes requests, as if every worker was stuck on a response
+	wsh.RequestQueue = make(chan ServerRequest)
+
+	_, changed := wsh.currentConn()
+	queued := make(chan bool)
+	go func() {
+		queued <- wsh.queueRequest(ServerRequest{ID: 1})
+	}()
+
+	// the connection drops under the handler
+	conn.Close()
+	if err := wsh.SendResponse(ServerResponse{SURB: []byte("surb"), Message: []byte("hi")}); err == nil {
+		t.Fatalf("writing to a dropped connection succeeded")
+	}
+
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("reader did not reconnect while waiting to queue a request")
+	}
+	select {
+	case req := <-wsh.RequestQueue:
+		if req.ID != 1 {
+			t.Fatalf("queued request %d, want 1", req.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("request was not queued after reconnecting")
+	}
+	if !<-queued {
+		t.Fatalf("queueRequest gave up")
+	}
+}
+
+// rejecting a malformed request happens on the reader too, a full response
+// queue behind a broken connection must not keep it from reconnecting
+func TestRejectRequestReconnectsOnFailedWrite(t *testing.T) {
+	mixnet := fakeNym.NewMixnet()
+	nymClient, err := mixnet.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nymClient.Close()
+	conn, err := nymClient.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	efs, err := eternityFS.InitEFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wsh := NewEFSHandler(conn, efs)
+	wsh.Dial = nymClient.Dial
+	// the response processor is stuck writing, the queue is full
+	wsh.ResponseQueue = make(chan ServerResponse, 1)
+	wsh.ResponseQueue <- ServerResponse{SURB: []byte("queued")}
+
+	_, changed := wsh.currentConn()
+	rejected := make(chan bool)
+	go func() {
+		rejected <- wsh.RejectRequest(ServerRequest{ID: 1, SURB: []byte("surb")}, &eternityProto.TruncatedFrameError{})
+	}()
+
+	conn.Close()
+	if err := wsh.SendResponse(ServerResponse{SURB: []byte("surb"), Message: []byte("hi")}); err == nil {
+		t.Fatalf("writing to a dropped connection succeeded")
+	}
+
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("reader did not reconnect while waiting to reject a request")
+	}
+	// the response processor gets going again on the new connection
+	if queued := <-wsh.ResponseQueue; string(queued.SURB) != "queued" {
+		t.Fatalf("first response has SURB %q", queued.SURB)
+	}
+	select {
+	case response := <-wsh.ResponseQueue:
+		if string(response.SURB) != "surb" {
+			t.Fatalf("rejection has SURB %q, want surb", response.SURB)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("rejection was not queued after reconnecting")
+	}
+	if !<-rejected {
+		t.Fatalf("RejectRequest gave up, the reader would stop")
+	}
+}
+
+// recorder sits between a handler and its fake nym-client and keeps a copy
+// of every frame passing in either direction
+type recorder struct {
+	toHandler   chan []byte
+	fromHandler chan []byte
+	url         string
+}
+
+func newRecorder(t *testing.T, nymClient *fakeNym.Client) *recorder {
+	rec := &recorder{
+		toHandler:   make(chan []byte, 100),
+		fromHandler: make(chan []byte, 100),
+	}
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerConn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer handlerConn.Close()
+		nymConn, err := nymClient.Dial()
+		if err != nil {
+			return
+		}
+		defer nymConn.Close()
+
+		go func() {
+			for {
+				_, frame, err := nymConn.ReadMessage()
+				if err != nil {
+					handlerConn.Close()
+					return
+				}
+				rec.toHandler <- frame
+				handlerConn.WriteMessage(websocket.BinaryMessage, frame)
+			}
+		}()
+		for {
+			_, frame, err := handlerConn.ReadMessage()
+			if err != nil {
+				return
+			}
+			rec.fromHandler <- frame
+			nymConn.WriteMessage(websocket.BinaryMessage, frame)
+		}
+	}))
+	t.Cleanup(server.Close)
+	rec.url = "ws" + strings.TrimPrefix(server.URL, "http")
+	return rec
+}
+
+// next returns the next frame with the given tag, skipping the others
+func next(t *testing.T, frames chan []byte, tag byte) []byte {
+	t.Helper()
+	for {
+		select {
+		case frame := <-frames:
+			if len(frame) > 0 && frame[0] == tag {
+				return frame
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no frame with tag 0x%02x", tag)
+		}
+	}
+}
+
+// the handler answers every request with exactly one reply frame, holding
+// the response through the SURB the request came with
+func TestReplyFrames(t *testing.T) {
+	mixnet := fakeNym.NewMixnet()
+	defer mixnet.Close()
+	serverClient, err := mixnet.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	userClient, err := mixnet.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := newRecorder(t, serverClient)
+	dial := DialNymClient(rec.url)
+	conn, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsh, err := NewWebsocketHandler(conn, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsh.Dial = dial
+	ctx, cancel := context.WithCancel(context.Background())
+	wsh.Start(ctx)
+	defer func() {
+		cancel()
+		<-wsh.Done()
+	}()
+
+	user, err := userClient.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer user.Close()
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := []byte("hello eternity")
+	fileHash := sha256.Sum256(file)
+	hash := fileHash[:]
+	// deletes must be signed after the file was stored, so they are made
+	// when their turn comes
+	deleteRequest := func(id uint64, sign func(time.Time) []byte) func() eternityProto.Request {
+		return func() eternityProto.Request {
+			signed := time.Now()
+			return eternityProto.NewDeleteRequest(id, hash, signed, sign(signed))
+		}
+	}
+	request := func(req eternityProto.Request) func() eternityProto.Request {
+		return func() eternityProto.Request { return req }
+	}
+
+	tests := []struct {
+		name string
+		req  func() eternityProto.Request
+		want func(eternityProto.Request) eternityProto.Response
+	}{
+		{
+			name: "search missing",
+			req:  request(eternityProto.NewSearchRequest(1, hash)),
+			want: func(req eternityProto.Request) eternityProto.Response {
+				return eternityProto.NewResponse(req, eternityProto.StatusNotFound)
+			},
+		},
+		{
+			name: "store",
+			req:  request(eternityProto.NewStoreRequest(2, pub, ed25519.Sign(priv, hash), file)),
+			want: func(req eternityProto.Request) eternityProto.Response {
+				return eternityProto.NewResponse(req, eternityProto.StatusOK).Set(eternityProto.FieldHash, hash)
+			},
+		},
+		{
+			name: "search",
+			req:  request(eternityProto.NewSearchRequest(3, hash)),
+			want: func(req eternityProto.Request) eternityProto.Response {
+				return eternityProto.NewResponse(req, eternityProto.StatusOK)
+			},
+		},
+		{
+			name: "serve",
+			req:  request(eternityProto.NewServeRequest(4, hash)),
+			want: func(req eternityProto.Request) eternityProto.Response {
+				return eternityProto.NewResponse(req, eternityProto.StatusOK).Set(eternityProto.FieldBody, file)
+			},
+		},
+		{
+			name: "delete with the upload signature",
+			req: deleteRequest(5, func(time.Time) []byte {
+				return ed25519.Sign(priv, hash)
+			}),
+			want: func(req eternityProto.Request) eternityProto.Response {
+				return errorResponse(req, &eternityFS.InvalidSignatureError{})
+			},
+		},
+		{
+			name: "delete",
+			req: deleteRequest(6, func(signed time.Time) []byte {
+				return ed25519.Sign(priv, eternityProto.DeleteSignatureData(hash, signed))
+			}),
+			want: func(req eternityProto.Request) eternityProto.Response {
+				return eternityProto.NewResponse(req, eternityProto.StatusOK)
+			},
+		},
+		{
+			name: "serve deleted",
+			req:  request(eternityProto.NewServeRequest(7, hash)),
+			want: func(req eternityProto.Request) eternityProto.Response {
+				return errorResponse(req, &eternityFS.FileNotFoundError{})
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req()
+			send := nymProto.MakeSendRequest(serverClient.Address, req.Encode(), true)
+			if err := user.WriteMessage(websocket.BinaryMessage, send); err != nil {
+				t.Fatal(err)
+			}
+
+			// the handler got the request with a SURB from the mixnet
+			received, err := nymProto.ParseReceived(next(t, rec.toHandler, nymProto.ReceivedResponseTag))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !received.HasSURB() || !bytes.Equal(received.Message, req.Encode()) {
+				t.Fatalf("handler received %x with SURB %x", received.Message, received.SURB)
+			}
+
+			// and answers through exactly that SURB
+			resp := tt.want(req).Encode()
+			want := nymProto.MakeReplyRequest(resp, received.SURB)
+			if got := next(t, rec.fromHandler, nymProto.ReplyRequestTag); !bytes.Equal(got, want) {
+				t.Fatalf("reply frame\n%x\nwant\n%x", got, want)
+			}
+
+			user.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, got, err := user.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := nymProto.MakeReceived(resp, nil); !bytes.Equal(got, want) {
+				t.Fatalf("user received\n%x\nwant\n%x", got, want)
+			}
+		})
+	}
+}
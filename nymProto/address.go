@@ -0,0 +1,98 @@
+package nymProto
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// a nym address is made of three 32 byte keys, written as
+// <client identity>.<client encryption key>@<gateway identity>
+// with each key base58 encoded
+const addressKeyLength = 32
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+type InvalidAddressError struct {
+	Address string
+	Reason  string
+}
+
+func (e *InvalidAddressError) Error() string {
+	return fmt.Sprintf("invalid nym address %q: %s", e.Address, e.Reason)
+}
+
+func base58Encode(data []byte) string {
+	n := new(big.Int).SetBytes(data)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+
+	out := make([]byte, 0, len(data)*138/100+1)
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+func base58Decode(s string) ([]byte, bool) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	for _, c := range []byte(s) {
+		digit := strings.IndexByte(base58Alphabet, c)
+		if digit < 0 {
+			return nil, false
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(digit)))
+	}
+
+	zeros := 0
+	for zeros < len(s) && s[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+	return append(make([]byte, zeros), n.Bytes()...), true
+}
+
+// FormatRecipient turns a binary nym address into its text form
+func FormatRecipient(address []byte) string {
+	if len(address) != AddressLength {
+		return base58Encode(address)
+	}
+	return base58Encode(address[:32]) + "." + base58Encode(address[32:64]) + "@" + base58Encode(address[64:])
+}
+
+// ParseRecipient turns the text form of a nym address into the binary form
+// used in send requests
+func ParseRecipient(address string) ([]byte, error) {
+	at := strings.Split(address, "@")
+	if len(at) != 2 {
+		return nil, &InvalidAddressError{Address: address, Reason: "expected exactly one '@'"}
+	}
+	client := strings.Split(at[0], ".")
+	if len(client) != 2 {
+		return nil, &InvalidAddressError{Address: address, Reason: "expected exactly one '.' before the '@'"}
+	}
+
+	out := make([]byte, 0, AddressLength)
+	for _, part := range []string{client[0], client[1], at[1]} {
+		key, ok := base58Decode(part)
+		if !ok {
+			return nil, &InvalidAddressError{Address: address, Reason: "invalid base58"}
+		}
+		if len(key) != addressKeyLength {
+			return nil, &InvalidAddressError{Address: address, Reason: fmt.Sprintf("key %q is %d bytes, expected %d", part, len(key), addressKeyLength)}
+		}
+		out = append(out, key...)
+	}
+	return out, nil
+}
@@ -0,0 +1,66 @@
+package nymProto
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRecipientRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		address []byte
+	}{
+		{"counting", testAddress()},
+		{"zeros", make([]byte, AddressLength)},
+		{"leading zeros", append(make([]byte, 5), bytes.Repeat([]byte{0xff}, AddressLength-5)...)},
+		{"ones", bytes.Repeat([]byte{0xff}, AddressLength)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text := FormatRecipient(tt.address)
+			if strings.Count(text, ".") != 1 || strings.Count(text, "@") != 1 {
+				t.Fatalf("formatted as %q", text)
+			}
+			address, err := ParseRecipient(text)
+			if err != nil {
+				t.Fatalf("parsing %q: %v", text, err)
+			}
+			if !bytes.Equal(address, tt.address) {
+				t.Fatalf("%q parsed as %x, want %x", text, address, tt.address)
+			}
+		})
+	}
+}
+
+func TestParseRecipient(t *testing.T) {
+	valid := FormatRecipient(testAddress())
+	client := strings.Split(valid, "@")[0]
+	keys := strings.Split(client, ".")
+
+	tests := []struct {
+		name    string
+		address string
+	}{
+		{"empty", ""},
+		{"no gateway", client},
+		{"two gateways", valid + "@" + keys[0]},
+		{"no encryption key", keys[0] + "@" + keys[1]},
+		{"three client keys", keys[0] + "." + keys[1] + "." + keys[0] + "@" + keys[1]},
+		{"not base58", keys[0] + ".0OIl@" + keys[1]},
+		{"short key", keys[0] + "." + keys[1][:10] + "@" + keys[1]},
+		{"empty key", "." + keys[1] + "@" + keys[1]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseRecipient(tt.address)
+			var addrErr *InvalidAddressError
+			if !errors.As(err, &addrErr) {
+				t.Fatalf("got error %v, want an *InvalidAddressError", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package nymProto
+
+import "fmt"
+
+// UnknownTagError is returned when a frame starts with a tag we do not
+// know how to decode
+type UnknownTagError struct {
+	Tag byte
+}
+
+func (e *UnknownTagError) Error() string {
+	return fmt.Sprintf("unknown response tag 0x%02x", e.Tag)
+}
+
+// TruncatedFrameError is returned when a frame ends before a field that
+// should be there
+type TruncatedFrameError struct {
+	Field string // the field we were trying to read
+	Need  int    // bytes needed to read the field
+	Have  int    // bytes left in the frame
+}
+
+func (e *TruncatedFrameError) Error() string {
+	return fmt.Sprintf("truncated frame: need %d bytes for %s, have %d", e.Need, e.Field, e.Have)
+}
+
+// LengthMismatchError is returned when a length prefix does not match the
+// number of bytes that follow it
+type LengthMismatchError struct {
+	Field    string
+	Declared uint64
+	Have     int
+}
+
+func (e *LengthMismatchError) Error() string {
+	return fmt.Sprintf("%s length mismatch: declared %d bytes, have %d", e.Field, e.Declared, e.Have)
+}
+
+// InvalidSurbFlagError is returned when the SURB flag of a received frame is
+// neither 0 nor 1
+type InvalidSurbFlagError struct {
+	Flag byte
+}
+
+func (e *InvalidSurbFlagError) Error() string {
+	return fmt.Sprintf("invalid SURB flag 0x%02x", e.Flag)
+}
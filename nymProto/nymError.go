@@ -0,0 +1,92 @@
+package nymProto
+
+/*****************
+
+# Error
+1 byte   	: 	Error response tag (0x00)
+1 byte   	: 	Error kind
+8 bytes  	: 	Message Length (ML)
+ML bytes 	: 	the error message
+
+*****************/
+
+import "fmt"
+
+// ErrorKind is the kind of error reported by the nym native client
+type ErrorKind byte
+
+const (
+	ErrorKindEmptyRequest     ErrorKind = 0x01
+	ErrorKindTooShortRequest  ErrorKind = 0x02
+	ErrorKindUnknownRequest   ErrorKind = 0x03
+	ErrorKindMalformedRequest ErrorKind = 0x04
+
+	ErrorKindEmptyResponse     ErrorKind = 0x10
+	ErrorKindTooShortResponse  ErrorKind = 0x11
+	ErrorKindUnknownResponse   ErrorKind = 0x12
+	ErrorKindMalformedResponse ErrorKind = 0x13
+
+	ErrorKindOther ErrorKind = 0xFF
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorKindEmptyRequest:
+		return "empty request"
+	case ErrorKindTooShortRequest:
+		return "too short request"
+	case ErrorKindUnknownRequest:
+		return "unknown request"
+	case ErrorKindMalformedRequest:
+		return "malformed request"
+	case ErrorKindEmptyResponse:
+		return "empty response"
+	case ErrorKindTooShortResponse:
+		return "too short response"
+	case ErrorKindUnknownResponse:
+		return "unknown response"
+	case ErrorKindMalformedResponse:
+		return "malformed response"
+	case ErrorKindOther:
+		return "other"
+	}
+	return fmt.Sprintf("unknown error kind 0x%02x", byte(k))
+}
+
+// NymClientError is an error reported to us by the nym native client, it
+// does not mean the connection is broken
+type NymClientError struct {
+	Kind    ErrorKind
+	Message string
+}
+
+func (e *NymClientError) Error() string {
+	return fmt.Sprintf("nym-client error (%s): %s", e.Kind, e.Message)
+}
+
+func MakeError(kind ErrorKind, message string) []byte {
+	out := []byte{ErrorResponseTag, byte(kind)}
+	out = putLen(out, len(message))
+	return append(out, message...)
+}
+
+// ParseError decodes an error frame. The decoded error is returned as the
+// first value, the second is set if the frame itself is malformed.
+func ParseError(rawResponse []byte) (*NymClientError, error) {
+	if len(rawResponse) < 2 {
+		return nil, &TruncatedFrameError{Field: "error header", Need: 2, Have: len(rawResponse)}
+	}
+	if rawResponse[0] != ErrorResponseTag {
+		return nil, &UnknownTagError{Tag: rawResponse[0]}
+	}
+
+	msg, _, err := readLenPrefixed(rawResponse[2:], "error message", true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NymClientError{
+		Kind:    ErrorKind(rawResponse[1]),
+		Message: string(msg),
+	}, nil
+}
@@ -0,0 +1,142 @@
+package nymProto
+
+/*****************
+
+Decoding of the binary frames sent to us by the nym native client.
+
+# Received
+1 byte   	: 	Received response tag (0x01)
+1 byte   	: 	SURB byte (0 or 1)
+if the SURB byte is 1:
+8 bytes  	: 	SURB Length (SL)
+SL bytes 	: 	Single Use Reply Block
+always:
+8 bytes  	: 	Message Length (ML)
+ML bytes 	: 	the message
+
+# Self Address
+1 byte   	: 	Self address response tag (0x02)
+96 bytes 	: 	our nym address
+
+*****************/
+
+import "encoding/binary"
+
+// response tags
+const ErrorResponseTag = 0x00
+const ReceivedResponseTag = 0x01
+const SelfAddressResponseTag = 0x02
+
+// AddressLength is the length of a binary nym address
+const AddressLength = 96
+
+// Received is a message that came in from the mixnet
+type Received struct {
+	SURB    []byte // nil if the sender did not attach a reply SURB
+	Message []byte
+}
+
+func (r Received) HasSURB() bool {
+	return r.SURB != nil
+}
+
+// MakeReceived encodes a received frame, a nil SURB is sent without one
+func MakeReceived(message []byte, surb []byte) []byte {
+	out := make([]byte, 0, 2+8+len(surb)+8+len(message))
+	out = append(out, ReceivedResponseTag)
+	if surb != nil {
+		out = append(out, 1)
+		out = putLen(out, len(surb))
+		out = append(out, surb...)
+	} else {
+		out = append(out, 0)
+	}
+	out = putLen(out, len(message))
+	out = append(out, message...)
+
+	return out
+}
+
+func MakeSelfAddressResponse(address []byte) []byte {
+	out := []byte{SelfAddressResponseTag}
+	return append(out, address...)
+}
+
+// readLenPrefixed reads an 8 byte big endian length followed by that many
+// bytes, returning the bytes and the rest of the data. If last is set the
+// declared length must cover exactly the rest of the data.
+func readLenPrefixed(data []byte, field string, last bool) ([]byte, []byte, error) {
+	if len(data) < 8 {
+		return nil, nil, &TruncatedFrameError{Field: field + " length", Need: 8, Have: len(data)}
+	}
+	declared := binary.BigEndian.Uint64(data[:8])
+	data = data[8:]
+
+	if declared > uint64(len(data)) || (last && declared != uint64(len(data))) {
+		return nil, nil, &LengthMismatchError{Field: field, Declared: declared, Have: len(data)}
+	}
+	return data[:declared], data[declared:], nil
+}
+
+// ParseReceived decodes a received frame, it never panics on bad input. If
+// the nym client sent an error frame instead it is returned as a
+// *NymClientError.
+func ParseReceived(rawResponse []byte) (Received, error) {
+	if len(rawResponse) > 0 && rawResponse[0] == ErrorResponseTag {
+		nymErr, err := ParseError(rawResponse)
+		if err != nil {
+			return Received{}, err
+		}
+		return Received{}, nymErr
+	}
+	if len(rawResponse) < 2 {
+		return Received{}, &TruncatedFrameError{Field: "received header", Need: 2, Have: len(rawResponse)}
+	}
+	if rawResponse[0] != ReceivedResponseTag {
+		return Received{}, &UnknownTagError{Tag: rawResponse[0]}
+	}
+
+	data := rawResponse[2:]
+	received := Received{}
+	switch rawResponse[1] {
+	case 0:
+	case 1:
+		surb, rest, err := readLenPrefixed(data, "SURB", false)
+		if err != nil {
+			return Received{}, err
+		}
+		received.SURB = surb
+		data = rest
+	default:
+		return Received{}, &InvalidSurbFlagError{Flag: rawResponse[1]}
+	}
+
+	msg, _, err := readLenPrefixed(data, "message", true)
+	if err != nil {
+		return Received{}, err
+	}
+	received.Message = msg
+
+	return received, nil
+}
+
+// ParseSelfAddress decodes a self address frame into the binary address
+func ParseSelfAddress(rawResponse []byte) ([]byte, error) {
+	if len(rawResponse) == 0 {
+		return nil, &TruncatedFrameError{Field: "tag", Need: 1, Have: 0}
+	}
+	if rawResponse[0] == ErrorResponseTag {
+		nymErr, err := ParseError(rawResponse)
+		if err != nil {
+			return nil, err
+		}
+		return nil, nymErr
+	}
+	if rawResponse[0] != SelfAddressResponseTag {
+		return nil, &UnknownTagError{Tag: rawResponse[0]}
+	}
+	if len(rawResponse) != AddressLength+1 {
+		return nil, &LengthMismatchError{Field: "address", Declared: AddressLength, Have: len(rawResponse) - 1}
+	}
+	return rawResponse[1:], nil
+}
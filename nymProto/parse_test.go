@@ -0,0 +1,145 @@
+package nymProto
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestResponses(t *testing.T) {
+	address := testAddress()
+	msg := []byte("hello mixnet")
+	surb := []byte("a single use reply block")
+
+	tests := []struct {
+		name  string
+		made  []byte
+		want  []byte
+		parse func([]byte) (interface{}, error)
+		value interface{}
+	}{
+		{
+			name: "received",
+			made: MakeReceived(msg, nil),
+			want: frame([]byte{ReceivedResponseTag, 0}, length(len(msg)), msg),
+			parse: func(b []byte) (interface{}, error) {
+				return ParseReceived(b)
+			},
+			value: Received{Message: msg},
+		},
+		{
+			name: "received with SURB",
+			made: MakeReceived(msg, surb),
+			want: frame([]byte{ReceivedResponseTag, 1}, length(len(surb)), surb, length(len(msg)), msg),
+			parse: func(b []byte) (interface{}, error) {
+				return ParseReceived(b)
+			},
+			value: Received{SURB: surb, Message: msg},
+		},
+		{
+			name: "received with empty SURB",
+			made: MakeReceived(msg, []byte{}),
+			want: frame([]byte{ReceivedResponseTag, 1}, length(0), length(len(msg)), msg),
+			parse: func(b []byte) (interface{}, error) {
+				return ParseReceived(b)
+			},
+			value: Received{SURB: []byte{}, Message: msg},
+		},
+		{
+			name: "self address",
+			made: MakeSelfAddressResponse(address),
+			want: frame([]byte{SelfAddressResponseTag}, address),
+			parse: func(b []byte) (interface{}, error) {
+				return ParseSelfAddress(b)
+			},
+			value: address,
+		},
+		{
+			name: "error",
+			made: MakeError(ErrorKindMalformedRequest, "bad frame"),
+			want: frame([]byte{ErrorResponseTag, byte(ErrorKindMalformedRequest)}, length(9), []byte("bad frame")),
+			parse: func(b []byte) (interface{}, error) {
+				return ParseError(b)
+			},
+			value: &NymClientError{Kind: ErrorKindMalformedRequest, Message: "bad frame"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !bytes.Equal(tt.made, tt.want) {
+				t.Fatalf("encoded as %x, want %x", tt.made, tt.want)
+			}
+			value, err := tt.parse(tt.made)
+			if err != nil {
+				t.Fatalf("parsing: %v", err)
+			}
+			if !reflect.DeepEqual(value, tt.value) {
+				t.Fatalf("parsed %+v, want %+v", value, tt.value)
+			}
+		})
+	}
+}
+
+// an error frame where a received or self address frame was expected comes
+// back as the nym client's error
+func TestErrorInsteadOfResponse(t *testing.T) {
+	errFrame := MakeError(ErrorKindOther, "gateway went away")
+	want := &NymClientError{Kind: ErrorKindOther, Message: "gateway went away"}
+
+	_, err := ParseReceived(errFrame)
+	var nymErr *NymClientError
+	if !errors.As(err, &nymErr) || !reflect.DeepEqual(nymErr, want) {
+		t.Errorf("ParseReceived: got %v, want %v", err, want)
+	}
+	_, err = ParseSelfAddress(errFrame)
+	if !errors.As(err, &nymErr) || !reflect.DeepEqual(nymErr, want) {
+		t.Errorf("ParseSelfAddress: got %v, want %v", err, want)
+	}
+}
+
+func TestMalformedResponses(t *testing.T) {
+	received := MakeReceived([]byte("hello"), []byte("surb"))
+	errFrame := MakeError(ErrorKindOther, "boom")
+
+	var (
+		tagErr       *UnknownTagError
+		truncatedErr *TruncatedFrameError
+		lengthErr    *LengthMismatchError
+		flagErr      *InvalidSurbFlagError
+	)
+	tests := []struct {
+		name   string
+		parse  func() error
+		target interface{}
+	}{
+		{"received empty", func() error { _, err := ParseReceived(nil); return err }, &truncatedErr},
+		{"received wrong tag", func() error { _, err := ParseReceived(frame([]byte{SelfAddressResponseTag}, received[1:])); return err }, &tagErr},
+		{"received bad SURB flag", func() error { _, err := ParseReceived(frame([]byte{ReceivedResponseTag, 7}, received[2:])); return err }, &flagErr},
+		{"received no SURB length", func() error { _, err := ParseReceived(received[:5]); return err }, &truncatedErr},
+		{"received cut SURB", func() error { _, err := ParseReceived(received[:2+8+2]); return err }, &lengthErr},
+		{"received cut message", func() error { _, err := ParseReceived(received[:len(received)-1]); return err }, &lengthErr},
+		{"received trailing bytes", func() error { _, err := ParseReceived(frame(received, []byte{0})); return err }, &lengthErr},
+		{"received huge length", func() error {
+			_, err := ParseReceived(frame([]byte{ReceivedResponseTag, 0}, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}))
+			return err
+		}, &lengthErr},
+		{"received cut error", func() error { _, err := ParseReceived(errFrame[:len(errFrame)-1]); return err }, &lengthErr},
+		{"self address empty", func() error { _, err := ParseSelfAddress(nil); return err }, &truncatedErr},
+		{"self address wrong tag", func() error { _, err := ParseSelfAddress(received); return err }, &tagErr},
+		{"self address short", func() error { _, err := ParseSelfAddress([]byte{SelfAddressResponseTag, 1, 2}); return err }, &lengthErr},
+		{"error short", func() error { _, err := ParseError([]byte{ErrorResponseTag}); return err }, &truncatedErr},
+		{"error wrong tag", func() error { _, err := ParseError(received); return err }, &tagErr},
+		{"error cut message", func() error { _, err := ParseError(errFrame[:len(errFrame)-1]); return err }, &lengthErr},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.parse()
+			if !errors.As(err, tt.target) {
+				t.Fatalf("got error %v (%T), want %T", err, err, tt.target)
+			}
+		})
+	}
+}
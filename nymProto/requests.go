@@ -0,0 +1,143 @@
+package nymProto
+
+/*****************
+
+Encoding of the binary frames we send to the nym native client.
+
+# Send
+1 byte   	: 	Send request tag (0x00)
+1 byte   	: 	SURB byte (1 to attach a reply SURB)
+96 bytes 	: 	recipient nym address
+8 bytes  	: 	Message Length (ML)
+ML bytes 	: 	the message
+
+# Reply
+1 byte   	: 	Reply request tag (0x01)
+8 bytes  	: 	SURB Length (SL)
+SL bytes 	: 	Single Use Reply Block
+8 bytes  	: 	Message Length (ML)
+ML bytes 	: 	the message
+
+# Self Address
+1 byte   	: 	Self address request tag (0x02)
+
+*****************/
+
+import "encoding/binary"
+
+// request tags
+const SendRequestTag = 0x00
+const ReplyRequestTag = 0x01
+const SelfAddressRequestTag = 0x02
+
+// SendRequest asks the nym client to send a message to another client
+type SendRequest struct {
+	Recipient     []byte
+	Message       []byte
+	WithReplySURB bool
+}
+
+// ReplyRequest asks the nym client to answer a message through its SURB
+type ReplyRequest struct {
+	SURB    []byte
+	Message []byte
+}
+
+func putLen(out []byte, n int) []byte {
+	length := make([]byte, 8)
+	binary.BigEndian.PutUint64(length, uint64(n))
+	return append(out, length...)
+}
+
+func MakeSelfAddressRequest() []byte {
+	return []byte{SelfAddressRequestTag}
+}
+
+// MakeSendRequest encodes a send request, the recipient must be a binary
+// address of AddressLength bytes (see ParseRecipient)
+func MakeSendRequest(recipient []byte, message []byte, withReplySurb bool) []byte {
+	surbByte := byte(0)
+	if withReplySurb {
+		surbByte = 1
+	}
+
+	out := make([]byte, 0, 2+len(recipient)+8+len(message))
+	out = append(out, SendRequestTag, surbByte)
+	out = append(out, recipient...)
+	out = putLen(out, len(message))
+	out = append(out, message...)
+
+	return out
+}
+
+func MakeReplyRequest(message []byte, replySURB []byte) []byte {
+	out := make([]byte, 0, 1+8+len(replySURB)+8+len(message))
+	out = append(out, ReplyRequestTag)
+	out = putLen(out, len(replySURB))
+	out = append(out, replySURB...)
+	out = putLen(out, len(message))
+	out = append(out, message...)
+
+	return out
+}
+
+func ParseSendRequest(rawRequest []byte) (SendRequest, error) {
+	if len(rawRequest) < 2+AddressLength {
+		return SendRequest{}, &TruncatedFrameError{Field: "send header", Need: 2 + AddressLength, Have: len(rawRequest)}
+	}
+	if rawRequest[0] != SendRequestTag {
+		return SendRequest{}, &UnknownTagError{Tag: rawRequest[0]}
+	}
+
+	request := SendRequest{
+		Recipient: rawRequest[2 : 2+AddressLength],
+	}
+	switch rawRequest[1] {
+	case 0:
+	case 1:
+		request.WithReplySURB = true
+	default:
+		return SendRequest{}, &InvalidSurbFlagError{Flag: rawRequest[1]}
+	}
+
+	msg, _, err := readLenPrefixed(rawRequest[2+AddressLength:], "message", true)
+	if err != nil {
+		return SendRequest{}, err
+	}
+	request.Message = msg
+
+	return request, nil
+}
+
+func ParseReplyRequest(rawRequest []byte) (ReplyRequest, error) {
+	if len(rawRequest) == 0 {
+		return ReplyRequest{}, &TruncatedFrameError{Field: "tag", Need: 1, Have: 0}
+	}
+	if rawRequest[0] != ReplyRequestTag {
+		return ReplyRequest{}, &UnknownTagError{Tag: rawRequest[0]}
+	}
+
+	surb, rest, err := readLenPrefixed(rawRequest[1:], "SURB", false)
+	if err != nil {
+		return ReplyRequest{}, err
+	}
+	msg, _, err := readLenPrefixed(rest, "message", true)
+	if err != nil {
+		return ReplyRequest{}, err
+	}
+
+	return ReplyRequest{SURB: surb, Message: msg}, nil
+}
+
+func ParseSelfAddressRequest(rawRequest []byte) error {
+	if len(rawRequest) == 0 {
+		return &TruncatedFrameError{Field: "tag", Need: 1, Have: 0}
+	}
+	if rawRequest[0] != SelfAddressRequestTag {
+		return &UnknownTagError{Tag: rawRequest[0]}
+	}
+	if len(rawRequest) != 1 {
+		return &LengthMismatchError{Field: "self address request", Declared: 0, Have: len(rawRequest) - 1}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package nymProto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// frame joins the parts of a hand built frame
+func frame(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// length is an 8 byte big endian length prefix
+func length(n int) []byte {
+	out := make([]byte, 8)
+	binary.BigEndian.PutUint64(out, uint64(n))
+	return out
+}
+
+func testAddress() []byte {
+	address := make([]byte, AddressLength)
+	for i := range address {
+		address[i] = byte(i + 1)
+	}
+	return address
+}
+
+func TestRequests(t *testing.T) {
+	recipient := testAddress()
+	msg := []byte("hello mixnet")
+	surb := []byte("a single use reply block")
+
+	tests := []struct {
+		name  string
+		made  []byte
+		want  []byte
+		parse func([]byte) (interface{}, error)
+		value interface{}
+	}{
+		{
+			name: "send",
+			made: MakeSendRequest(recipient, msg, false),
+			want: frame([]byte{SendRequestTag, 0}, recipient, length(len(msg)), msg),
+			parse: func(b []byte) (interface{}, error) {
+				return ParseSendRequest(b)
+			},
+			value: SendRequest{Recipient: recipient, Message: msg},
+		},
+		{
+			name: "send with SURB",
+			made: MakeSendRequest(recipient, msg, true),
+			want: frame([]byte{SendRequestTag, 1}, recipient, length(len(msg)), msg),
+			parse: func(b []byte) (interface{}, error) {
+				return ParseSendRequest(b)
+			},
+			value: SendRequest{Recipient: recipient, Message: msg, WithReplySURB: true},
+		},
+		{
+			name: "send empty message",
+			made: MakeSendRequest(recipient, []byte{}, false),
+			want: frame([]byte{SendRequestTag, 0}, recipient, length(0)),
+			parse: func(b []byte) (interface{}, error) {
+				return ParseSendRequest(b)
+			},
+			value: SendRequest{Recipient: recipient, Message: []byte{}},
+		},
+		{
+			name: "reply",
+			made: MakeReplyRequest(msg, surb),
+			want: frame([]byte{ReplyRequestTag}, length(len(surb)), surb, length(len(msg)), msg),
+			parse: func(b []byte) (interface{}, error) {
+				return ParseReplyRequest(b)
+			},
+			value: ReplyRequest{SURB: surb, Message: msg},
+		},
+		{
+			name: "self address",
+			made: MakeSelfAddressRequest(),
+			want: []byte{SelfAddressRequestTag},
+			parse: func(b []byte) (interface{}, error) {
+				return nil, ParseSelfAddressRequest(b)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !bytes.Equal(tt.made, tt.want) {
+				t.Fatalf("encoded as %x, want %x", tt.made, tt.want)
+			}
+			value, err := tt.parse(tt.made)
+			if err != nil {
+				t.Fatalf("parsing: %v", err)
+			}
+			if !reflect.DeepEqual(value, tt.value) {
+				t.Fatalf("parsed %+v, want %+v", value, tt.value)
+			}
+		})
+	}
+}
+
+func TestMalformedRequests(t *testing.T) {
+	recipient := testAddress()
+	send := MakeSendRequest(recipient, []byte("hello"), false)
+	reply := MakeReplyRequest([]byte("hello"), []byte("surb"))
+
+	var (
+		tagErr       *UnknownTagError
+		truncatedErr *TruncatedFrameError
+		lengthErr    *LengthMismatchError
+		flagErr      *InvalidSurbFlagError
+	)
+	tests := []struct {
+		name   string
+		parse  func() error
+		target interface{}
+	}{
+		{"send empty", func() error { _, err := ParseSendRequest(nil); return err }, &truncatedErr},
+		{"send short recipient", func() error { _, err := ParseSendRequest(send[:50]); return err }, &truncatedErr},
+		{"send wrong tag", func() error { _, err := ParseSendRequest(frame([]byte{ReplyRequestTag}, send[1:])); return err }, &tagErr},
+		{"send bad SURB flag", func() error { _, err := ParseSendRequest(frame([]byte{SendRequestTag, 2}, send[2:])); return err }, &flagErr},
+		{"send no length", func() error { _, err := ParseSendRequest(send[:2+AddressLength]); return err }, &truncatedErr},
+		{"send cut message", func() error { _, err := ParseSendRequest(send[:len(send)-1]); return err }, &lengthErr},
+		{"send trailing bytes", func() error { _, err := ParseSendRequest(frame(send, []byte{0})); return err }, &lengthErr},
+		{"reply empty", func() error { _, err := ParseReplyRequest(nil); return err }, &truncatedErr},
+		{"reply wrong tag", func() error { _, err := ParseReplyRequest(send); return err }, &tagErr},
+		{"reply cut SURB", func() error { _, err := ParseReplyRequest(reply[:1+8+2]); return err }, &lengthErr},
+		{"reply cut message", func() error { _, err := ParseReplyRequest(reply[:len(reply)-1]); return err }, &lengthErr},
+		{"self address empty", func() error { return ParseSelfAddressRequest(nil) }, &truncatedErr},
+		{"self address wrong tag", func() error { return ParseSelfAddressRequest([]byte{SendRequestTag}) }, &tagErr},
+		{"self address trailing bytes", func() error { return ParseSelfAddressRequest([]byte{SelfAddressRequestTag, 0}) }, &lengthErr},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.parse()
+			if !errors.As(err, tt.target) {
+				t.Fatalf("got error %v (%T), want %T", err, err, tt.target)
+			}
+		})
+	}
+}
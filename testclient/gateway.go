@@ -0,0 +1,413 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"eternity/nymProto"
+	"eternityTestClient/nymRequests"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// the largest file the gateway takes from a browser
+const maxGatewayUpload = 1 << 30
+
+// multipart uploads bigger than this are spooled to disk while parsing
+const gatewayFormMemory = 32 << 20
+
+// how long a finished upload is kept for a page that has not asked for its
+// result, one that has is forgotten straight away
+const finishedUploadTTL = 10 * time.Minute
+
+// gateway serves the upload page and forwards the files posted to it over
+// nym. All uploads share one session with the server, which is opened with
+// the first upload and again for the next upload after the connection to
+// nym-client is lost.
+type gateway struct {
+	id      nymRequests.Identity
+	nymURI  string
+	timeout time.Duration
+	hosts   map[string]bool // Host headers we answer to
+
+	mut     sync.Mutex // guards everything below
+	server  string
+	session *nymRequests.Session
+	uploads map[string]*gatewayUpload
+	running int
+}
+
+// gatewayUpload is the state of an upload as reported to the browser
+type gatewayUpload struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Size    int       `json:"size"`
+	Private bool      `json:"private"`
+	State   string    `json:"state"` // uploading, done or failed
+	Stored  int       `json:"stored"`
+	Total   int       `json:"total"` // chunks, 0 until the server told us what it needs
+	Hash    string    `json:"hash,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Started time.Time `json:"started"`
+
+	finished time.Time // zero while uploading
+}
+
+type NoServerAddressError struct{}
+
+func (e *NoServerAddressError) Error() string {
+	return "no server address, set one on the page or start the gateway with -server"
+}
+
+type UploadsRunningError struct {
+	Running int
+}
+
+func (e *UploadsRunningError) Error() string {
+	return fmt.Sprintf("%d upload(s) still running on the current server", e.Running)
+}
+
+type ForeignHostError struct {
+	Host string
+}
+
+func (e *ForeignHostError) Error() string {
+	return fmt.Sprintf("the gateway is not served as %q", e.Host)
+}
+
+type CrossOriginError struct {
+	Origin string
+}
+
+func (e *CrossOriginError) Error() string {
+	return fmt.Sprintf("requests from %s are not accepted", e.Origin)
+}
+
+// newGateway makes a gateway reached at the listen address and at the
+// extra host names
+func newGateway(id nymRequests.Identity, opts options, listen string, extra []string) *gateway {
+	return &gateway{
+		id:      id,
+		nymURI:  opts.nymURI,
+		timeout: opts.timeout,
+		hosts:   gatewayHosts(listen, extra),
+		server:  opts.server,
+		uploads: make(map[string]*gatewayUpload),
+	}
+}
+
+// gatewayHosts lists the Host headers of requests meant for us, the listen
+// address and extra names as given and every loopback name if we listen on
+// loopback or on all addresses
+func gatewayHosts(listen string, extra []string) map[string]bool {
+	hosts := map[string]bool{listen: true}
+	for _, name := range extra {
+		hosts[name] = true
+	}
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return hosts
+	}
+	ip := net.ParseIP(host)
+	if host == "" || host == "localhost" || ip != nil && (ip.IsLoopback() || ip.IsUnspecified()) {
+		for _, loopback := range []string{"localhost", "127.0.0.1", "::1"} {
+			hosts[net.JoinHostPort(loopback, port)] = true
+		}
+	}
+	return hosts
+}
+
+// sameOrigin keeps other sites from using the gateway through the browser of
+// whoever runs it. Requests must name one of our hosts, which a page that
+// rebinds its own name to us can not, and anything but a read must come from
+// our own page. Clients that send no Origin are not browsers and get through.
+func (g *gateway) sameOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !g.hosts[r.Host] {
+			writeError(w, http.StatusForbidden, &ForeignHostError{Host: r.Host})
+			return
+		}
+		origin := r.Header.Get("Origin")
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && origin != "" && origin != "http://"+r.Host {
+			writeError(w, http.StatusForbidden, &CrossOriginError{Origin: origin})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (g *gateway) routes(staticDir string) http.Handler {
+	r := mux.NewRouter()
+	r.Use(g.sameOrigin)
+	r.HandleFunc("/address", g.getAddress).Methods(http.MethodGet)
+	r.HandleFunc("/address", g.setAddress).Methods(http.MethodPost)
+	r.HandleFunc("/upload", g.listUploads).Methods(http.MethodGet)
+	r.HandleFunc("/upload", g.upload).Methods(http.MethodPost)
+	r.HandleFunc("/upload/{id}", g.uploadStatus).Methods(http.MethodGet)
+	r.PathPrefix("/").Handler(http.FileServer(http.Dir(staticDir))).Methods(http.MethodGet, http.MethodHead)
+	return r
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("writing response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (g *gateway) getAddress(w http.ResponseWriter, r *http.Request) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	writeJSON(w, http.StatusOK, map[string]string{"address": g.server})
+}
+
+// setAddress changes the server uploads go to, the page posts it in the
+// gateway field. It is refused while uploads to the old server are running.
+func (g *gateway) setAddress(w http.ResponseWriter, r *http.Request) {
+	address := r.FormValue("gateway")
+	if _, err := nymProto.ParseRecipient(address); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	if address != g.server {
+		if g.running > 0 {
+			writeError(w, http.StatusConflict, &UploadsRunningError{Running: g.running})
+			return
+		}
+		if g.session != nil {
+			g.session.Close()
+			g.session = nil
+		}
+		g.server = address
+		log.Printf("uploading to %s", address)
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"address": g.server})
+}
+
+// currentSession returns the session with the server, connecting to our
+// nym-client if there is none. Must be called with g.mut held.
+func (g *gateway) currentSession() (*nymRequests.Session, error) {
+	if g.server == "" {
+		return nil, &NoServerAddressError{}
+	}
+	if g.session != nil {
+		select {
+		case <-g.session.Done():
+			// nym-client went away, try it again
+			g.session.Close()
+		default:
+			return g.session, nil
+		}
+	}
+	s, err := g.id.Vars(g.server).Connect(g.nymURI)
+	if err != nil {
+		return nil, err
+	}
+	s.Timeout = g.timeout
+	g.session = s
+	return s, nil
+}
+
+func newUploadID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// upload takes a multipart file and starts sending it to the server, the
+// browser follows it at /upload/{id}
+func (g *gateway) upload(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxGatewayUpload)
+	if err := r.ParseMultipartForm(gatewayFormMemory); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	part, header, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	file, err := ioutil.ReadAll(part)
+	part.Close()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	encrypt := r.FormValue("encrypt") != ""
+	if r.FormValue("private") != "" && !encrypt {
+		writeError(w, http.StatusBadRequest, errors.New("private files must be encrypted, the server would see the file"))
+		return
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	g.mut.Lock()
+	s, err := g.currentSession()
+	if err != nil {
+		g.mut.Unlock()
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	if encrypt {
+		if file, err = s.Vars.Encrypt(file); err != nil {
+			g.mut.Unlock()
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	u := &gatewayUpload{
+		ID:      id,
+		Name:    header.Filename,
+		Size:    len(file),
+		Private: encrypt,
+		State:   "uploading",
+		Started: time.Now(),
+	}
+	g.pruneUploads(time.Now())
+	g.uploads[id] = u
+	g.running++
+	status := *u
+	g.mut.Unlock()
+
+	log.Printf("upload %s: %s, %d bytes", id, u.Name, u.Size)
+	go g.send(s, u, file)
+
+	w.Header().Set("Location", "/upload/"+id)
+	writeJSON(w, http.StatusAccepted, status)
+}
+
+// send runs an upload to the end, recording progress as chunks are stored
+func (g *gateway) send(s *nymRequests.Session, u *gatewayUpload, file []byte) {
+	hash, err := s.UploadWithProgress(file, u.Private, func(stored int, total int) {
+		g.mut.Lock()
+		u.Stored = stored
+		u.Total = total
+		g.mut.Unlock()
+	})
+
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	g.running--
+	u.finished = time.Now()
+	g.pruneUploads(u.finished)
+	if err != nil {
+		u.State = "failed"
+		u.Error = err.Error()
+		log.Printf("upload %s failed: %v", u.ID, err)
+		return
+	}
+	u.State = "done"
+	u.Hash = hex.EncodeToString(hash)
+	log.Printf("upload %s stored as %s", u.ID, u.Hash)
+}
+
+func (g *gateway) uploadStatus(w http.ResponseWriter, r *http.Request) {
+	g.mut.Lock()
+	id := mux.Vars(r)["id"]
+	u, ok := g.uploads[id]
+	var status gatewayUpload
+	if ok {
+		status = *u
+		if !u.finished.IsZero() {
+			// the page stops asking once it has the result
+			delete(g.uploads, id)
+		}
+	}
+	g.mut.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("no such upload"))
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (g *gateway) listUploads(w http.ResponseWriter, r *http.Request) {
+	g.mut.Lock()
+	g.pruneUploads(time.Now())
+	list := make([]gatewayUpload, 0, len(g.uploads))
+	for _, u := range g.uploads {
+		list = append(list, *u)
+	}
+	g.mut.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started.Before(list[j].Started)
+	})
+	writeJSON(w, http.StatusOK, list)
+}
+
+// pruneUploads forgets uploads that finished more than finishedUploadTTL
+// before now, the caller must hold the lock
+func (g *gateway) pruneUploads(now time.Time) {
+	for id, u := range g.uploads {
+		if !u.finished.IsZero() && now.Sub(u.finished) > finishedUploadTTL {
+			delete(g.uploads, id)
+		}
+	}
+}
+
+func (g *gateway) close() {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	if g.session != nil {
+		g.session.Close()
+		g.session = nil
+	}
+}
+
+func serveGateway(args []string) error {
+	opts := options{}
+	fs := flags("gateway", &opts, true, false)
+	listen := fs.String("listen", "localhost:8000", "address to serve the upload page on")
+	staticDir := fs.String("static", "static", "directory holding the upload page")
+	hostnames := fs.String("hostnames", "", "comma separated host:port names the page is also reached by, requests for any other are refused")
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	if opts.server != "" {
+		if _, err := nymProto.ParseRecipient(opts.server); err != nil {
+			return err
+		}
+	}
+
+	id, err := identity(opts)
+	if err != nil {
+		return err
+	}
+	var extra []string
+	if *hostnames != "" {
+		extra = strings.Split(*hostnames, ",")
+	}
+	g := newGateway(id, opts, *listen, extra)
+	defer g.close()
+
+	log.Printf("upload page on http://%s/ as %s", *listen, id.Name)
+	return http.ListenAndServe(*listen, g.routes(*staticDir))
+}
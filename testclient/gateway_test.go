@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"eternity/nymProto"
+	"eternityTestClient/nymRequests"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGatewayRefusesOtherSites(t *testing.T) {
+	id, err := nymRequests.NewKeyring().Generate("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newGateway(id, options{}, "localhost:8000", []string{"gateway.lan:8000"})
+	handler := g.routes(t.TempDir())
+	address := nymProto.FormatRecipient(bytes.Repeat([]byte{1}, nymProto.AddressLength))
+
+	tests := []struct {
+		name   string
+		method string
+		host   string
+		origin string
+		want   int
+	}{
+		{"own page", http.MethodPost, "localhost:8000", "http://localhost:8000", http.StatusOK},
+		{"loopback address", http.MethodPost, "127.0.0.1:8000", "http://127.0.0.1:8000", http.StatusOK},
+		{"extra host name", http.MethodPost, "gateway.lan:8000", "http://gateway.lan:8000", http.StatusOK},
+		{"no origin", http.MethodPost, "localhost:8000", "", http.StatusOK},
+		{"other site", http.MethodPost, "localhost:8000", "http://evil.example", http.StatusForbidden},
+		{"other port", http.MethodPost, "localhost:8000", "http://localhost:9000", http.StatusForbidden},
+		{"null origin", http.MethodPost, "localhost:8000", "null", http.StatusForbidden},
+		{"rebound name", http.MethodPost, "evil.example:8000", "http://evil.example:8000", http.StatusForbidden},
+		{"rebound name read", http.MethodGet, "evil.example:8000", "", http.StatusForbidden},
+		{"cross origin read", http.MethodGet, "localhost:8000", "http://evil.example", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r *http.Request
+			if tt.method == http.MethodPost {
+				form := url.Values{"gateway": {address}}
+				r = httptest.NewRequest(tt.method, "/address", strings.NewReader(form.Encode()))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				r = httptest.NewRequest(tt.method, "/address", nil)
+			}
+			r.Host = tt.host
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+
+	g.server = ""
+	r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(""))
+	r.Host = "localhost:8000"
+	r.Header.Set("Origin", "http://evil.example")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("cross origin upload: status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestGatewayRefusesPrivateInTheClear(t *testing.T) {
+	id, err := nymRequests.NewKeyring().Generate("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newGateway(id, options{}, "localhost:8000", nil)
+	handler := g.routes(t.TempDir())
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "secret.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("a secret"))
+	form.WriteField("private", "on")
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	r.Host = "localhost:8000"
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("private upload in the clear: status %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+	if len(g.uploads) != 0 {
+		t.Fatalf("private upload in the clear was started")
+	}
+}
+
+func TestGatewayForgetsFinishedUploads(t *testing.T) {
+	id, err := nymRequests.NewKeyring().Generate("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newGateway(id, options{}, "localhost:8000", nil)
+	handler := g.routes(t.TempDir())
+	now := time.Now()
+	g.uploads = map[string]*gatewayUpload{
+		"running":     {ID: "running", State: "uploading", Started: now.Add(-time.Hour)},
+		"done":        {ID: "done", State: "done", finished: now},
+		"failed":      {ID: "failed", State: "failed", finished: now},
+		"stale done":  {ID: "stale done", State: "done", finished: now.Add(-finishedUploadTTL - time.Minute)},
+		"stale fails": {ID: "stale fails", State: "failed", finished: now.Add(-finishedUploadTTL - time.Minute)},
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Host = "localhost:8000"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// uploads nobody asked about are forgotten once they are stale
+	if w := get("/upload"); w.Code != http.StatusOK {
+		t.Fatalf("list: status %d", w.Code)
+	}
+	for _, id := range []string{"stale done", "stale fails"} {
+		if _, ok := g.uploads[id]; ok {
+			t.Errorf("%s is still listed", id)
+		}
+	}
+
+	// the result of a finished upload is given once
+	for _, id := range []string{"done", "failed"} {
+		if w := get("/upload/" + id); w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", id, w.Code)
+		}
+		if w := get("/upload/" + id); w.Code != http.StatusNotFound {
+			t.Fatalf("%s asked for again: status %d, want %d", id, w.Code, http.StatusNotFound)
+		}
+	}
+
+	// running uploads stay however long they take
+	for i := 0; i < 2; i++ {
+		if w := get("/upload/running"); w.Code != http.StatusOK {
+			t.Fatalf("running upload: status %d", w.Code)
+		}
+	}
+	if len(g.uploads) != 1 {
+		t.Fatalf("%d uploads left, want the running one", len(g.uploads))
+	}
+}
@@ -1,8 +1,14 @@
 module eternityTestClient
 
-go 1.17
+go 1.18
 
 require (
+	eternity v0.0.0
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/websocket v1.4.2
+	golang.org/x/term v0.15.0
 )
+
+require golang.org/x/sys v0.15.0 // indirect
+
+replace eternity => ../
@@ -1,33 +1,488 @@
 package main
 
 import (
-	nL "eternity/nymLib"
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"eternity/eternityProto"
+	"eternityTestClient/nymRequests"
+	"flag"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
-	"github.com/gorilla/websocket"
+	"golang.org/x/term"
 )
 
-func main() {
-	// message := "Hello Nym!"
+const usage = `usage: %[1]s <command> [flags] [args]
+
+commands:
+	put <file>	upload a file and print its SHA-256 hash
+	get <hash>	download a file to stdout, or to the file given with -o
+	has <hash>	tell if the server holds a file, exits 1 if it does not
+	rm <hash>	delete a file you stored
+	whoami		print the identity requests are signed with
+	keygen <name>	add a new identity to the keyring
+	import <name>	add an identity exported with export, read from stdin
+	export		print the identity to move it to another keyring
+	import-aes	replace the AES key of the identity, read from stdin
+	set-default <name>	make an identity the one used by default
+	gateway		serve an upload page that forwards files to the server
+
+Hashes can be written in hex or base64. Commands that talk to a server take
+-server (or ETERNITY_SERVER) with its nym address, the keyring passphrase is
+read from ETERNITY_PASSPHRASE or asked for.
+
+run "%[1]s <command> -h" for the flags of a command
+`
+
+type options struct {
+	keyring  string
+	identity string
+	server   string
+	nymURI   string
+	timeout  time.Duration
+	private  bool
+	encrypt  bool
+	out      string
+}
+
+type UsageError struct {
+	Reason string
+}
+
+func (e *UsageError) Error() string {
+	return e.Reason
+}
+
+func envOr(name string, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return fallback
+}
+
+// flags makes the flag set of a command, network commands get the server
+// flags and visibility commands -private and -encrypt
+func flags(cmd string, opts *options, network bool, visibility bool) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	fs.StringVar(&opts.keyring, "keyring", envOr("ETERNITY_KEYRING", nymRequests.DefaultKeyringPath()), "keyring file (env ETERNITY_KEYRING)")
+	fs.StringVar(&opts.identity, "identity", "", "identity to use instead of the default one")
+	if network {
+		fs.StringVar(&opts.server, "server", os.Getenv("ETERNITY_SERVER"), "nym address of the eternity server (env ETERNITY_SERVER)")
+		fs.StringVar(&opts.nymURI, "nym-uri", envOr("ETERNITY_NYM_URI", nymRequests.DefaultNymURI), "websocket URI of your nym-client (env ETERNITY_NYM_URI)")
+		fs.DurationVar(&opts.timeout, "timeout", nymRequests.DefaultTimeout, "how long to wait for each reply")
+	}
+	if visibility {
+		fs.BoolVar(&opts.private, "private", false, "the file is private, only you can find and read it, put needs -encrypt")
+		fs.BoolVar(&opts.encrypt, "encrypt", false, "the file is encrypted with your AES key, implies -private")
+	}
+	return fs
+}
+
+// parse parses the flags of a command and checks it got want arguments
+func parse(fs *flag.FlagSet, args []string, want int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != want {
+		return nil, &UsageError{Reason: fmt.Sprintf("%s takes %d argument(s), got %d", fs.Name(), want, fs.NArg())}
+	}
+	return fs.Args(), nil
+}
+
+// stdin is shared by everything reading lines, so none of them loses what
+// another one buffered
+var stdin = bufio.NewReader(os.Stdin)
+
+// readLine prompts on stderr and reads a line from stdin
+func readLine(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// passphrase comes from ETERNITY_PASSPHRASE or stdin, a terminal does not
+// echo it
+func passphrase() ([]byte, error) {
+	if value, ok := os.LookupEnv("ETERNITY_PASSPHRASE"); ok {
+		return []byte(value), nil
+	}
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "keyring passphrase: ")
+		pass, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return pass, err
+	}
+	line, err := readLine("keyring passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	return []byte(line), nil
+}
+
+func identity(opts options) (nymRequests.Identity, error) {
+	pass, err := passphrase()
+	if err != nil {
+		return nymRequests.Identity{}, err
+	}
+	k, err := nymRequests.LoadKeyring(opts.keyring, pass)
+	if errors.Is(err, os.ErrNotExist) {
+		return nymRequests.Identity{}, fmt.Errorf("no keyring at %s, make one with keygen", opts.keyring)
+	} else if err != nil {
+		return nymRequests.Identity{}, err
+	}
+	if opts.identity != "" {
+		return k.Identity(opts.identity)
+	}
+	return k.DefaultIdentity()
+}
+
+// connect starts a session with the server as our identity
+func connect(opts options) (*nymRequests.Session, error) {
+	if opts.server == "" {
+		return nil, &UsageError{Reason: "no server address, use -server or ETERNITY_SERVER"}
+	}
+	id, err := identity(opts)
+	if err != nil {
+		return nil, err
+	}
+	s, err := id.Vars(opts.server).Connect(opts.nymURI)
+	if err != nil {
+		return nil, err
+	}
+	s.Timeout = opts.timeout
+	return s, nil
+}
+
+func put(args []string) error {
+	opts := options{}
+	fs := flags("put", &opts, true, true)
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if opts.private && !opts.encrypt {
+		// the server would still see the file
+		return &UsageError{Reason: "put -private uploads the file in the clear, use -encrypt to store a private file"}
+	}
+	file, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	s, err := connect(opts)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	var hash []byte
+	if opts.encrypt {
+		hash, err = s.UploadEncrypted(file)
+	} else {
+		hash, err = s.Upload(file)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(hex.EncodeToString(hash))
+	return nil
+}
+
+func get(args []string) error {
+	opts := options{}
+	fs := flags("get", &opts, true, true)
+	fs.StringVar(&opts.out, "o", "", "write the file here instead of to stdout")
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	hash, err := eternityProto.ParseHash(args[0])
+	if err != nil {
+		return err
+	}
+
+	s, err := connect(opts)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	var file []byte
+	switch {
+	case opts.encrypt:
+		file, err = s.DownloadEncrypted(hash)
+	case opts.private:
+		file, err = s.DownloadPrivate(hash)
+	default:
+		file, err = s.Download(hash)
+	}
+	if err != nil {
+		return err
+	}
+
+	if opts.out == "" {
+		_, err = os.Stdout.Write(file)
+		return err
+	}
+	return ioutil.WriteFile(opts.out, file, 0644)
+}
+
+type NotFoundError struct{}
+
+func (e *NotFoundError) Error() string {
+	return "not found"
+}
+
+func has(args []string) error {
+	opts := options{}
+	fs := flags("has", &opts, true, true)
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	hash, err := eternityProto.ParseHash(args[0])
+	if err != nil {
+		return err
+	}
 
-	uri := "ws://localhost:1977"
+	s, err := connect(opts)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
 
-	conn, _, err := websocket.DefaultDialer.Dial(uri, nil)
+	var found bool
+	if opts.private || opts.encrypt {
+		found, err = s.SearchPrivate(hash)
+	} else {
+		found, err = s.Search(hash)
+	}
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if !found {
+		return &NotFoundError{}
 	}
-	defer conn.Close()
+	fmt.Println("found")
+	return nil
+}
 
-	rec := "J24dDRezY2BULGEAK9zKWfDxkywvg5EyPYmVEmUJVFNH.3CHWoonozybwVUopVTwkWvobaVD5WfQdfiNoyjew9aBw@6LdVTJhRfJKsrUtnjFqE3TpEbCYs3VZoxmaoNFqRWn4x"
-	readData, err := ioutil.ReadFile("file_example_PNG_2500kB.jpg")
+func rm(args []string) error {
+	opts := options{}
+	fs := flags("rm", &opts, true, false)
+	args, err := parse(fs, args, 1)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	hash, err := eternityProto.ParseHash(args[0])
+	if err != nil {
+		return err
+	}
+
+	s, err := connect(opts)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return s.Delete(hash)
+}
+
+func whoami(args []string) error {
+	opts := options{}
+	fs := flags("whoami", &opts, false, false)
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	id, err := identity(opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("identity:   %s\n", id.Name)
+	fmt.Printf("public key: %s\n", hex.EncodeToString(id.PublicKey()))
+	fmt.Printf("keyring:    %s\n", opts.keyring)
+	return nil
+}
+
+// editKeyring loads the keyring, or starts one if create is set and there is
+// none, lets edit change it and saves it
+func editKeyring(opts options, create bool, edit func(k *nymRequests.Keyring) error) error {
+	pass, err := passphrase()
+	if err != nil {
+		return err
+	}
+	k, err := nymRequests.LoadKeyring(opts.keyring, pass)
+	if create && errors.Is(err, os.ErrNotExist) {
+		k = nymRequests.NewKeyring()
+	} else if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no keyring at %s, make one with keygen", opts.keyring)
+	} else if err != nil {
+		return err
+	}
+
+	if err := edit(k); err != nil {
+		return err
+	}
+	return k.Save(opts.keyring, pass)
+}
+
+func keygen(args []string) error {
+	opts := options{}
+	fs := flags("keygen", &opts, false, false)
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	var id nymRequests.Identity
+	err = editKeyring(opts, true, func(k *nymRequests.Keyring) (err error) {
+		id, err = k.Generate(args[0])
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("added %s, public key %s\n", id.Name, hex.EncodeToString(id.PublicKey()))
+	return nil
+}
+
+// importIdentity reads the identity from stdin rather than the command line,
+// where other users could see it
+func importIdentity(args []string) error {
+	opts := options{}
+	fs := flags("import", &opts, false, false)
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	var id nymRequests.Identity
+	err = editKeyring(opts, true, func(k *nymRequests.Keyring) error {
+		exported, err := readLine("exported identity: ")
+		if err != nil {
+			return err
+		}
+		id, err = k.ImportIdentity(args[0], exported)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("added %s, public key %s\n", id.Name, hex.EncodeToString(id.PublicKey()))
+	return nil
+}
+
+func exportIdentity(args []string) error {
+	opts := options{}
+	fs := flags("export", &opts, false, false)
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	id, err := identity(opts)
+	if err != nil {
+		return err
+	}
+	fmt.Println(id.Export())
+	return nil
+}
+
+func importAES(args []string) error {
+	opts := options{}
+	fs := flags("import-aes", &opts, false, false)
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	var name string
+	err := editKeyring(opts, false, func(k *nymRequests.Keyring) error {
+		name = opts.identity
+		if name == "" {
+			id, err := k.DefaultIdentity()
+			if err != nil {
+				return err
+			}
+			name = id.Name
+		}
+		exported, err := readLine("AES key: ")
+		if err != nil {
+			return err
+		}
+		return k.ImportAES(name, exported)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("replaced the AES key of %s\n", name)
+	return nil
+}
+
+func setDefault(args []string) error {
+	opts := options{}
+	fs := flags("set-default", &opts, false, false)
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	err = editKeyring(opts, false, func(k *nymRequests.Keyring) error {
+		return k.SetDefault(args[0])
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s is the default identity\n", args[0])
+	return nil
+}
+
+func main() {
+	name := filepath.Base(os.Args[0])
+	if len(os.Args) < 2 {
+		fmt.Fprintf(os.Stderr, usage, name)
+		os.Exit(2)
+	}
+
+	commands := map[string]func([]string) error{
+		"put":         put,
+		"get":         get,
+		"has":         has,
+		"rm":          rm,
+		"whoami":      whoami,
+		"keygen":      keygen,
+		"import":      importIdentity,
+		"export":      exportIdentity,
+		"import-aes":  importAES,
+		"set-default": setDefault,
+		"gateway":     serveGateway,
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		if os.Args[1] == "help" || os.Args[1] == "-h" || os.Args[1] == "--help" {
+			fmt.Printf(usage, name)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", os.Args[1])
+		fmt.Fprintf(os.Stderr, usage, name)
+		os.Exit(2)
 	}
 
-	sendRequest := nL.MakeSendRequest([]byte(rec), readData, true)
-	fmt.Printf("sending content of 'file_example_PNG_2500KB.jpg' over the mix network...\n")
-	if err = conn.WriteMessage(websocket.BinaryMessage, sendRequest); err != nil {
-		panic(err)
+	err := cmd(os.Args[2:])
+	var usageErr *UsageError
+	var notFoundErr *NotFoundError
+	switch {
+	case err == nil:
+	case errors.Is(err, flag.ErrHelp):
+		os.Exit(2)
+	case errors.As(err, &usageErr):
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		os.Exit(2)
+	case errors.As(err, &notFoundErr):
+		fmt.Println("not found")
+		os.Exit(1)
+	default:
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"eternityTestClient/nymRequests"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPutRefusesPrivateInTheClear(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "secret.txt")
+	if err := ioutil.WriteFile(file, []byte("a secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var usageErr *UsageError
+	err := put([]string{"-private", file})
+	if !errors.As(err, &usageErr) || !strings.Contains(usageErr.Reason, "-encrypt") {
+		t.Fatalf("put -private: %v, want a UsageError pointing at -encrypt", err)
+	}
+}
+
+// run runs a command with input on stdin and returns what it printed
+func run(t *testing.T, cmd func([]string) error, args []string, input string) (string, error) {
+	t.Helper()
+	oldStdin, oldStdout, oldStderr := stdin, os.Stdout, os.Stderr
+	defer func() { stdin, os.Stdout, os.Stderr = oldStdin, oldStdout, oldStderr }()
+	stdin = bufio.NewReader(strings.NewReader(input))
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	os.Stdout, os.Stderr = w, devNull
+
+	printed := make(chan string)
+	go func() {
+		out, _ := ioutil.ReadAll(r)
+		printed <- string(out)
+	}()
+	err = cmd(args)
+	w.Close()
+	return <-printed, err
+}
+
+func TestKeyringCommands(t *testing.T) {
+	keyring := filepath.Join(t.TempDir(), "keyring.json")
+	t.Setenv("ETERNITY_KEYRING", keyring)
+	t.Setenv("ETERNITY_PASSPHRASE", "passphrase")
+	load := func() *nymRequests.Keyring {
+		t.Helper()
+		k, err := nymRequests.LoadKeyring(keyring, []byte("passphrase"))
+		if err != nil {
+			t.Fatalf("LoadKeyring: %v", err)
+		}
+		return k
+	}
+
+	if _, err := run(t, keygen, []string{"alice"}, ""); err != nil {
+		t.Fatalf("keygen: %v", err)
+	}
+	exported, err := run(t, exportIdentity, nil, "")
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	exported = strings.TrimSpace(exported)
+
+	// import reads the identity from stdin
+	if _, err := run(t, importIdentity, []string{"bob"}, exported+"\n"); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	k := load()
+	alice, _ := k.Identity("alice")
+	bob, err := k.Identity("bob")
+	if err != nil || alice.Export() != exported || bob.Export() != exported {
+		t.Fatalf("imported identity does not match the exported one: %v", err)
+	}
+	if _, err := run(t, importIdentity, []string{"bob"}, exported+"\n"); err == nil {
+		t.Fatalf("import of an existing name succeeded")
+	}
+	if _, err := run(t, importIdentity, []string{"carol"}, "not an identity\n"); err == nil {
+		t.Fatalf("import of garbage succeeded")
+	}
+
+	if _, err := run(t, setDefault, []string{"bob"}, ""); err != nil {
+		t.Fatalf("set-default: %v", err)
+	}
+	if id, err := load().DefaultIdentity(); err != nil || id.Name != "bob" {
+		t.Fatalf("default identity %q, %v, want bob", id.Name, err)
+	}
+	if _, err := run(t, setDefault, []string{"carol"}, ""); err == nil {
+		t.Fatalf("set-default to a missing identity succeeded")
+	}
+
+	// import-aes replaces the key of the default identity only
+	aesKey, err := nymRequests.GenerateAESKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exportedAES, err := nymRequests.ExportAESKey(aesKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run(t, importAES, nil, exportedAES+"\n"); err != nil {
+		t.Fatalf("import-aes: %v", err)
+	}
+	k = load()
+	bob, _ = k.Identity("bob")
+	alice, _ = k.Identity("alice")
+	if !bytes.Equal(bob.AESKey, aesKey) || bytes.Equal(alice.AESKey, aesKey) {
+		t.Fatalf("import-aes did not replace just the default identity's key")
+	}
+	if !bob.SigningKey.Equal(alice.SigningKey) {
+		t.Fatalf("import-aes changed the signing key")
+	}
+	if _, err := run(t, importAES, []string{"-identity", "alice"}, "short\n"); err == nil {
+		t.Fatalf("import-aes of a bad key succeeded")
+	}
+
+	// bob exported elsewhere carries the new AES key
+	moved, err := run(t, exportIdentity, []string{"-identity", "bob"}, "")
+	if err != nil {
+		t.Fatalf("export bob: %v", err)
+	}
+	other := nymRequests.NewKeyring()
+	bobThere, err := other.ImportIdentity("bob", strings.TrimSpace(moved))
+	if err != nil || !bytes.Equal(bobThere.AESKey, aesKey) || !bobThere.SigningKey.Equal(bob.SigningKey) {
+		t.Fatalf("bob moved to another keyring with different keys: %v", err)
+	}
+}
+
+func TestKeyringCommandsWrongPassphrase(t *testing.T) {
+	keyring := filepath.Join(t.TempDir(), "keyring.json")
+	t.Setenv("ETERNITY_KEYRING", keyring)
+	t.Setenv("ETERNITY_PASSPHRASE", "passphrase")
+	if _, err := run(t, keygen, []string{"alice"}, ""); err != nil {
+		t.Fatalf("keygen: %v", err)
+	}
+	before, err := ioutil.ReadFile(keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("ETERNITY_PASSPHRASE", "not the passphrase")
+	commands := []struct {
+		name  string
+		cmd   func([]string) error
+		args  []string
+		input string
+	}{
+		{"export", exportIdentity, nil, ""},
+		{"keygen", keygen, []string{"bob"}, ""},
+		{"import", importIdentity, []string{"bob"}, "x.y\n"},
+		{"import-aes", importAES, nil, "x\n"},
+		{"set-default", setDefault, []string{"alice"}, ""},
+	}
+	for _, c := range commands {
+		t.Run(c.name, func(t *testing.T) {
+			var wrongErr *nymRequests.WrongPassphraseError
+			if out, err := run(t, c.cmd, c.args, c.input); !errors.As(err, &wrongErr) || out != "" {
+				t.Fatalf("%q, %v, want WrongPassphraseError and nothing printed", out, err)
+			}
+			if after, err := ioutil.ReadFile(keyring); err != nil || !bytes.Equal(after, before) {
+				t.Fatalf("keyring changed: %v", err)
+			}
+		})
+	}
+}
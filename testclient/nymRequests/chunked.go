@@ -0,0 +1,328 @@
+package nymRequests
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"eternity/eternityProto"
+	"fmt"
+	"sync"
+)
+
+// ChunkWorkers is how many chunk requests are in flight at once
+const ChunkWorkers = 8
+
+// MaxRounds is how many times we go back for chunks that did not make it
+// before giving up on a transfer
+const MaxRounds = 5
+
+type IncompleteTransferError struct {
+	Missing []uint32
+	Err     error // the last error seen for a missing chunk
+}
+
+func (e *IncompleteTransferError) Error() string {
+	return fmt.Sprintf("%d chunks still missing after %d rounds, last error: %v", len(e.Missing), MaxRounds, e.Err)
+}
+
+func (e *IncompleteTransferError) Unwrap() error {
+	return e.Err
+}
+
+// forEachChunk runs fn for every index using ChunkWorkers goroutines and
+// returns the indexes for which fn failed along with the last error
+func forEachChunk(indexes []uint32, fn func(index uint32) error) ([]uint32, error) {
+	var mut sync.Mutex
+	var failed []uint32
+	var lastErr error
+
+	work := make(chan uint32)
+	var wg sync.WaitGroup
+	for i := 0; i < ChunkWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range work {
+				if err := fn(index); err != nil {
+					mut.Lock()
+					failed = append(failed, index)
+					lastErr = err
+					mut.Unlock()
+				}
+			}
+		}()
+	}
+	for _, index := range indexes {
+		work <- index
+	}
+	close(work)
+	wg.Wait()
+
+	return failed, lastErr
+}
+
+// Upload stores a file of any size in chunks, each chunk is its own nym
+// message with its own SURB. Chunks that get lost are sent again, and an
+// interrupted upload of the same file can be resumed by calling Upload
+// again. The SHA-256 hash of the file is returned.
+func (s *Session) Upload(file []byte) ([]byte, error) {
+	return s.UploadWithProgress(file, false, nil)
+}
+
+// UploadPrivate is Upload for a file only we can find and read back
+func (s *Session) UploadPrivate(file []byte) ([]byte, error) {
+	return s.UploadWithProgress(file, true, nil)
+}
+
+// ProgressFunc is told how many chunks of an upload the server holds, it
+// is called from several goroutines but never at the same time
+type ProgressFunc func(stored int, total int)
+
+// UploadWithProgress is Upload or UploadPrivate reporting progress after
+// every chunk the server acknowledges, progress may be nil
+func (s *Session) UploadWithProgress(file []byte, private bool, progress ProgressFunc) ([]byte, error) {
+	privKey, err := s.Vars.signingKey()
+	if err != nil {
+		return nil, err
+	}
+	m := eternityProto.NewManifest(file, eternityProto.DefaultChunkSize)
+	sig := ed25519.Sign(privKey, m.FileHash)
+	publicKey := privKey.Public().(ed25519.PublicKey)
+	total := int(m.ChunkCount())
+
+	var progressMut sync.Mutex
+	stored := 0
+	report := func(n int) {
+		if progress == nil {
+			return
+		}
+		progressMut.Lock()
+		stored = n
+		progress(stored, total)
+		progressMut.Unlock()
+	}
+	chunkStored := func() {
+		if progress == nil {
+			return
+		}
+		progressMut.Lock()
+		stored++
+		progress(stored, total)
+		progressMut.Unlock()
+	}
+
+	var lastErr error
+	var missing []uint32
+	for round := 0; round < MaxRounds; round++ {
+		// (re)announcing the upload tells us which chunks the server still
+		// needs
+		req := eternityProto.NewStoreManifestRequest(0, m, publicKey, sig).
+			Set(eternityProto.FieldVisibility, visibility(private))
+		resp, err := s.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err := resp.Err(); err != nil {
+			return nil, err
+		}
+		missing, err = eternityProto.DecodeIndexes(resp.Get(eternityProto.FieldMissing))
+		if err != nil {
+			return nil, err
+		}
+		if len(missing) == 0 {
+			report(total)
+			return m.FileHash, nil
+		}
+		report(total - len(missing))
+
+		var doneMut sync.Mutex
+		done := false
+		failed, err := forEachChunk(missing, func(index uint32) error {
+			resp, err := s.Do(eternityProto.NewStoreChunkRequest(0, m.FileHash, publicKey, index, m.Chunk(file, index),
+				ed25519.Sign(privKey, eternityProto.ChunkSignatureData(m.FileHash, index))))
+			if err != nil {
+				return err
+			}
+			if err := resp.Err(); err != nil {
+				return err
+			}
+			chunkStored()
+			if resp.Get(eternityProto.FieldHash) != nil {
+				doneMut.Lock()
+				done = true
+				doneMut.Unlock()
+			}
+			return nil
+		})
+		if done {
+			report(total)
+			return m.FileHash, nil
+		}
+		if len(failed) > 0 {
+			lastErr = err
+		}
+	}
+
+	return nil, &IncompleteTransferError{Missing: missing, Err: lastErr}
+}
+
+// UploadStatus asks the server which chunks of an interrupted upload of ours
+// it is still missing, an empty list means the file is stored
+func (s *Session) UploadStatus(hash []byte) ([]uint32, error) {
+	privKey, err := s.Vars.signingKey()
+	if err != nil {
+		return nil, err
+	}
+	req := eternityProto.NewUploadStatusRequest(0, hash, privKey.Public().(ed25519.PublicKey),
+		ed25519.Sign(privKey, eternityProto.ReadSignatureData(hash)))
+	resp, err := s.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := resp.Err(); err != nil {
+		return nil, err
+	}
+	return eternityProto.DecodeIndexes(resp.Get(eternityProto.FieldMissing))
+}
+
+// Download is a chunked download in progress, chunks that have not arrived
+// yet can be fetched again with FetchChunks
+type Download struct {
+	Manifest eternityProto.Manifest
+	Private  bool // chunk requests are signed for a private file
+
+	mut    sync.Mutex
+	chunks [][]byte
+}
+
+func (d *Download) Missing() []uint32 {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	out := make([]uint32, 0)
+	for i, chunk := range d.chunks {
+		if chunk == nil {
+			out = append(out, uint32(i))
+		}
+	}
+	return out
+}
+
+// Bytes assembles the downloaded file and checks it against the manifest
+func (d *Download) Bytes() ([]byte, error) {
+	if missing := d.Missing(); len(missing) > 0 {
+		return nil, &IncompleteTransferError{Missing: missing}
+	}
+
+	file := make([]byte, 0, d.Manifest.Size)
+	for _, chunk := range d.chunks {
+		file = append(file, chunk...)
+	}
+	fileHash := sha256.Sum256(file)
+	if !bytes.Equal(fileHash[:], d.Manifest.FileHash) {
+		return nil, &HashMismatchError{}
+	}
+	return file, nil
+}
+
+// StartDownload fetches the manifest of a public file, chunks are fetched
+// with FetchChunks
+func (s *Session) StartDownload(hash []byte) (*Download, error) {
+	return s.startDownload(hash, false)
+}
+
+// StartPrivateDownload is StartDownload for a private file of ours
+func (s *Session) StartPrivateDownload(hash []byte) (*Download, error) {
+	return s.startDownload(hash, true)
+}
+
+func (s *Session) startDownload(hash []byte, private bool) (*Download, error) {
+	req, err := s.readSignature(eternityProto.NewServeManifestRequest(0, hash), hash, private)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := resp.Err(); err != nil {
+		return nil, err
+	}
+	m, err := eternityProto.DecodeManifest(resp.Get(eternityProto.FieldManifest))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(m.FileHash, hash) {
+		return nil, &HashMismatchError{}
+	}
+
+	return &Download{
+		Manifest: m,
+		Private:  private,
+		chunks:   make([][]byte, m.ChunkCount()),
+	}, nil
+}
+
+// FetchChunks requests every chunk of the download we don't have yet, each
+// with its own SURB. Chunks that fail are left missing.
+func (s *Session) FetchChunks(d *Download) error {
+	hash := d.Manifest.FileHash
+	failed, err := forEachChunk(d.Missing(), func(index uint32) error {
+		req, err := s.readSignature(eternityProto.NewServeChunkRequest(0, hash, index), hash, d.Private)
+		if err != nil {
+			return err
+		}
+		resp, err := s.Do(req)
+		if err != nil {
+			return err
+		}
+		if err := resp.Err(); err != nil {
+			return err
+		}
+		chunk := resp.Get(eternityProto.FieldBody)
+		if err := d.Manifest.VerifyChunk(index, chunk); err != nil {
+			return err
+		}
+		d.mut.Lock()
+		d.chunks[index] = chunk
+		d.mut.Unlock()
+		return nil
+	})
+	if len(failed) > 0 {
+		return &IncompleteTransferError{Missing: d.Missing(), Err: err}
+	}
+	return nil
+}
+
+// Download fetches a public file of any size in chunks, going back for a
+// lost manifest or missing chunks up to MaxRounds times
+func (s *Session) Download(hash []byte) ([]byte, error) {
+	return s.download(hash, false)
+}
+
+// DownloadPrivate is Download for a private file of ours
+func (s *Session) DownloadPrivate(hash []byte) ([]byte, error) {
+	return s.download(hash, true)
+}
+
+func (s *Session) download(hash []byte, private bool) ([]byte, error) {
+	var d *Download
+	var err error
+	for round := 0; round < MaxRounds; round++ {
+		if d == nil {
+			// the manifest can get lost like any chunk
+			d, err = s.startDownload(hash, private)
+			var timeoutErr *TimeoutError
+			if errors.As(err, &timeoutErr) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		if err = s.FetchChunks(d); err == nil {
+			return d.Bytes()
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,99 @@
+package nymRequests
+
+import (
+	"bytes"
+	"eternity/eternityProto"
+	"eternity/fakeNym"
+	"testing"
+	"time"
+)
+
+// uploads and downloads get through a mixnet that loses, duplicates and
+// reorders messages and expires SURBs. The conditions are seeded, so the
+// mixnet misbehaves the same number of times on every run.
+func TestTransferUnderConditions(t *testing.T) {
+	tests := []struct {
+		name  string
+		cond  fakeNym.Conditions
+		stats func(fakeNym.Stats) int // what the conditions did
+	}{
+		{
+			name:  "drop",
+			cond:  fakeNym.Conditions{DropRate: 0.1, Seed: 1},
+			stats: func(s fakeNym.Stats) int { return s.Dropped },
+		},
+		{
+			name:  "duplicate",
+			cond:  fakeNym.Conditions{DuplicateRate: 0.3, Seed: 2},
+			stats: func(s fakeNym.Stats) int { return s.Duplicated },
+		},
+		{
+			name: "reorder",
+			cond: fakeNym.Conditions{
+				Delay:        fakeNym.UniformDelay(0, 5*time.Millisecond),
+				ReorderRate:  0.3,
+				ReorderDelay: 20 * time.Millisecond,
+				Seed:         3,
+			},
+			stats: func(s fakeNym.Stats) int { return s.Reordered },
+		},
+		{
+			name: "SURB lifetime",
+			cond: fakeNym.Conditions{
+				Delay:        fakeNym.UniformDelay(0, 40*time.Millisecond),
+				SURBLifetime: 35 * time.Millisecond,
+				Seed:         6,
+			},
+			stats: func(s fakeNym.Stats) int { return s.ExpiredSURBs },
+		},
+		{
+			name: "everything",
+			cond: fakeNym.Conditions{
+				Delay:         fakeNym.UniformDelay(0, 40*time.Millisecond),
+				DropRate:      0.05,
+				DuplicateRate: 0.1,
+				ReorderRate:   0.1,
+				ReorderDelay:  20 * time.Millisecond,
+				SURBLifetime:  50 * time.Millisecond,
+				Seed:          5,
+			},
+			stats: func(s fakeNym.Stats) int { return s.Dropped + s.Duplicated + s.Reordered + s.ExpiredSURBs },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mixnet := fakeNym.NewMixnet()
+			defer mixnet.Close()
+			s := newSession(t, mixnet, startServer(t, mixnet))
+			// lost messages are noticed by their replies not coming back
+			s.Timeout = 300 * time.Millisecond
+			mixnet.SetConditions(tt.cond)
+
+			file := testFile(8*eternityProto.DefaultChunkSize+100, tt.cond.Seed)
+			hash, err := s.Upload(file)
+			if err != nil {
+				t.Fatalf("Upload: %v (%+v)", err, mixnet.Stats())
+			}
+			if !bytes.Equal(hash, hashOf(file)) {
+				t.Fatalf("uploaded as %x, want %x", hash, hashOf(file))
+			}
+			downloaded, err := s.Download(hash)
+			if err != nil {
+				t.Fatalf("Download: %v (%+v)", err, mixnet.Stats())
+			}
+			if !bytes.Equal(downloaded, file) {
+				t.Fatalf("downloaded file differs from the upload")
+			}
+
+			stats := mixnet.Stats()
+			if tt.stats(stats) == 0 {
+				t.Fatalf("the conditions never applied: %+v", stats)
+			}
+			if stats.Delivered == 0 || stats.Sent < 2*int(eternityProto.NewManifest(file, eternityProto.DefaultChunkSize).ChunkCount()) {
+				t.Fatalf("too little traffic for an upload and download: %+v", stats)
+			}
+			t.Logf("%+v", stats)
+		})
+	}
+}
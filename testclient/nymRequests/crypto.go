@@ -0,0 +1,187 @@
+package nymRequests
+
+/*****************
+
+Files are encrypted on the client before they are uploaded, the server only
+ever sees ciphertext and stores it under the hash of the ciphertext. Every
+file gets its own AES-256-GCM key, derived from ClientVars.AESkey and a
+random salt with HKDF-SHA256.
+
+# Encrypted file
+1 byte   	: 	Format version (0x01)
+16 bytes 	: 	Salt for the file key
+12 bytes 	: 	GCM nonce
+rest     	: 	AES-GCM ciphertext followed by the 16 byte tag
+
+*****************/
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+const cipherVersion = 0x01
+const saltLength = 16
+const nonceLength = 12
+const tagLength = 16
+
+// AESKeyLength is the length of the keys we generate, imported keys may
+// also be 16 or 24 bytes
+const AESKeyLength = 32
+
+type NoAESKeyError struct{}
+
+func (e *NoAESKeyError) Error() string {
+	return "no AES key set in the client vars"
+}
+
+type InvalidAESKeyError struct {
+	Length int
+}
+
+func (e *InvalidAESKeyError) Error() string {
+	return fmt.Sprintf("AES keys are 16, 24 or 32 bytes, not %d", e.Length)
+}
+
+type CiphertextError struct {
+	Reason string
+}
+
+func (e *CiphertextError) Error() string {
+	return "can not decrypt file: " + e.Reason
+}
+
+func checkAESKey(key []byte) error {
+	switch len(key) {
+	case 0:
+		return &NoAESKeyError{}
+	case 16, 24, 32:
+		return nil
+	}
+	return &InvalidAESKeyError{Length: len(key)}
+}
+
+// GenerateAESKey makes a new random key for ClientVars.AESkey
+func GenerateAESKey() ([]byte, error) {
+	key := make([]byte, AESKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ExportAESKey encodes a key so it can be written down or passed around
+func ExportAESKey(key []byte) (string, error) {
+	if err := checkAESKey(key); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+// ImportAESKey decodes a key made by ExportAESKey
+func ImportAESKey(exported string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(exported)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAESKey(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// fileKey derives the key of one file with HKDF-SHA256 (RFC 5869), one
+// block of output is all we need
+func fileKey(masterKey []byte, salt []byte) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(masterKey)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	expand.Write([]byte("eternity file key"))
+	expand.Write([]byte{0x01})
+	return expand.Sum(nil)
+}
+
+func fileCipher(masterKey []byte, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(fileKey(masterKey, salt))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt seals a file with a key derived from AESkey
+func (cV ClientVars) Encrypt(file []byte) ([]byte, error) {
+	if err := checkAESKey(cV.AESkey); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 1+saltLength+nonceLength)
+	header[0] = cipherVersion
+	if _, err := rand.Read(header[1:]); err != nil {
+		return nil, err
+	}
+	salt := header[1 : 1+saltLength]
+	nonce := header[1+saltLength:]
+
+	gcm, err := fileCipher(cV.AESkey, salt)
+	if err != nil {
+		return nil, err
+	}
+	// the header is authenticated along with the file
+	return gcm.Seal(header, nonce, file, header), nil
+}
+
+// Decrypt opens a file made by Encrypt
+func (cV ClientVars) Decrypt(encrypted []byte) ([]byte, error) {
+	if err := checkAESKey(cV.AESkey); err != nil {
+		return nil, err
+	}
+	headerLength := 1 + saltLength + nonceLength
+	if len(encrypted) < headerLength+tagLength {
+		return nil, &CiphertextError{Reason: "too short"}
+	}
+	if encrypted[0] != cipherVersion {
+		return nil, &CiphertextError{Reason: fmt.Sprintf("unknown format version %d", encrypted[0])}
+	}
+	header := encrypted[:headerLength]
+	salt := header[1 : 1+saltLength]
+	nonce := header[1+saltLength:]
+
+	gcm, err := fileCipher(cV.AESkey, salt)
+	if err != nil {
+		return nil, err
+	}
+	file, err := gcm.Open(nil, nonce, encrypted[headerLength:], header)
+	if err != nil {
+		return nil, &CiphertextError{Reason: "wrong key or the file was changed"}
+	}
+	return file, nil
+}
+
+// UploadEncrypted encrypts a file with our AES key and uploads it as a
+// private file. The hash returned is that of the ciphertext, which is what
+// the server knows the file by.
+func (s *Session) UploadEncrypted(file []byte) ([]byte, error) {
+	encrypted, err := s.Vars.Encrypt(file)
+	if err != nil {
+		return nil, err
+	}
+	return s.UploadPrivate(encrypted)
+}
+
+// DownloadEncrypted downloads a file stored with UploadEncrypted and
+// decrypts it
+func (s *Session) DownloadEncrypted(hash []byte) ([]byte, error) {
+	encrypted, err := s.DownloadPrivate(hash)
+	if err != nil {
+		return nil, err
+	}
+	return s.Vars.Decrypt(encrypted)
+}
@@ -0,0 +1,111 @@
+package nymRequests
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func testVars(t *testing.T) ClientVars {
+	t.Helper()
+	key, err := GenerateAESKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ClientVars{AESkey: key}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	cV := testVars(t)
+	for _, file := range [][]byte{{}, []byte("a secret"), testFile(3*4096+7, 1)} {
+		encrypted, err := cV.Encrypt(file)
+		if err != nil {
+			t.Fatalf("Encrypt: %v", err)
+		}
+		if len(file) > 0 && bytes.Contains(encrypted, file) {
+			t.Fatalf("the file is in the clear in the ciphertext")
+		}
+		decrypted, err := cV.Decrypt(encrypted)
+		if err != nil {
+			t.Fatalf("Decrypt: %v", err)
+		}
+		if !bytes.Equal(decrypted, file) {
+			t.Fatalf("Decrypt gave %d bytes, want the %d we encrypted", len(decrypted), len(file))
+		}
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	cV := testVars(t)
+	encrypted, err := cV.Encrypt([]byte("do not change me"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerLength := 1 + saltLength + nonceLength
+
+	tests := []struct {
+		name   string
+		offset int
+	}{
+		{"version", 0},
+		{"salt", 1},
+		{"nonce", 1 + saltLength},
+		{"ciphertext", headerLength},
+		{"tag", len(encrypted) - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := append([]byte(nil), encrypted...)
+			tampered[tt.offset] ^= 0x01
+			var cipherErr *CiphertextError
+			if _, err := cV.Decrypt(tampered); !errors.As(err, &cipherErr) {
+				t.Fatalf("Decrypt: %v, want CiphertextError", err)
+			}
+		})
+	}
+
+	var cipherErr *CiphertextError
+	if _, err := cV.Decrypt(encrypted[:headerLength+tagLength-1]); !errors.As(err, &cipherErr) {
+		t.Fatalf("Decrypt of a truncated file: %v, want CiphertextError", err)
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	encrypted, err := testVars(t).Encrypt([]byte("not for you"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cipherErr *CiphertextError
+	if _, err := testVars(t).Decrypt(encrypted); !errors.As(err, &cipherErr) {
+		t.Fatalf("Decrypt with another key: %v, want CiphertextError", err)
+	}
+	var noKeyErr *NoAESKeyError
+	if _, err := (ClientVars{}).Decrypt(encrypted); !errors.As(err, &noKeyErr) {
+		t.Fatalf("Decrypt without a key: %v, want NoAESKeyError", err)
+	}
+}
+
+func TestFileKeysDiffer(t *testing.T) {
+	cV := testVars(t)
+	file := []byte("stored twice")
+	first, err := cV.Encrypt(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cV.Encrypt(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(hashOf(first), hashOf(second)) {
+		t.Fatalf("the same file encrypted twice has the same hash")
+	}
+
+	firstKey := fileKey(cV.AESkey, first[1:1+saltLength])
+	secondKey := fileKey(cV.AESkey, second[1:1+saltLength])
+	if bytes.Equal(firstKey, secondKey) {
+		t.Fatalf("two files share a file key")
+	}
+	if bytes.Equal(firstKey, cV.AESkey) {
+		t.Fatalf("the file key is the master key")
+	}
+}
@@ -0,0 +1,417 @@
+package nymRequests
+
+/*****************
+
+The keyring holds the identities of a user, each an ED25519 signing key
+and an AES key for encrypting files. On disk it is JSON encrypted with
+AES-256-GCM under a key derived from a passphrase with PBKDF2-HMAC-SHA256:
+
+	{
+		"version":    1,
+		"iterations": PBKDF2 iterations, 100000 to 6000000,
+		"salt":       base64 PBKDF2 salt,
+		"nonce":      base64 GCM nonce,
+		"ciphertext": base64 sealed keyring
+	}
+
+*****************/
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const keyringVersion = 1
+
+// KeyringIterations is the PBKDF2 work factor for new keyrings
+const KeyringIterations = 600000
+
+// a keyring asking for fewer iterations is too cheap to guess at and one
+// asking for more would keep us busy for minutes, neither is one we made
+const minKeyringIterations = 100000
+const maxKeyringIterations = 10 * KeyringIterations
+
+type IdentityNotFoundError struct {
+	Name string
+}
+
+func (e *IdentityNotFoundError) Error() string {
+	return fmt.Sprintf("no identity named %q in the keyring", e.Name)
+}
+
+type IdentityExistsError struct {
+	Name string
+}
+
+func (e *IdentityExistsError) Error() string {
+	return fmt.Sprintf("the keyring already has an identity named %q", e.Name)
+}
+
+type NoDefaultIdentityError struct{}
+
+func (e *NoDefaultIdentityError) Error() string {
+	return "the keyring has no default identity"
+}
+
+type WrongPassphraseError struct{}
+
+func (e *WrongPassphraseError) Error() string {
+	return "wrong passphrase or damaged keyring"
+}
+
+type UnsupportedKeyringError struct {
+	Version int
+}
+
+func (e *UnsupportedKeyringError) Error() string {
+	return fmt.Sprintf("unsupported keyring version %d", e.Version)
+}
+
+type KeyringIterationsError struct {
+	Iterations int
+}
+
+func (e *KeyringIterationsError) Error() string {
+	return fmt.Sprintf("keyring asks for %d PBKDF2 iterations, expected %d to %d", e.Iterations, minKeyringIterations, maxKeyringIterations)
+}
+
+type InvalidIdentityError struct {
+	Reason string
+}
+
+func (e *InvalidIdentityError) Error() string {
+	return "invalid identity: " + e.Reason
+}
+
+// Identity is a signing key and the AES key files are encrypted with
+type Identity struct {
+	Name       string             `json:"name"`
+	SigningKey ed25519.PrivateKey `json:"signingkey"`
+	AESKey     []byte             `json:"aeskey"`
+}
+
+func (id Identity) PublicKey() ed25519.PublicKey {
+	return id.SigningKey.Public().(ed25519.PublicKey)
+}
+
+// Vars are the client vars to talk to a server as this identity
+func (id Identity) Vars(serverAddress string) ClientVars {
+	return ClientVars{
+		ServerAddress: serverAddress,
+		Pubkey:        id.PublicKey(),
+		Privkey:       id.SigningKey,
+		AESkey:        id.AESKey,
+	}
+}
+
+// Export encodes the identity as "<signing key seed>.<AES key>" in
+// unpadded base64url, to be moved to another keyring with ImportIdentity.
+// Anyone holding it can act as the identity.
+func (id Identity) Export() string {
+	return base64.RawURLEncoding.EncodeToString(id.SigningKey.Seed()) + "." +
+		base64.RawURLEncoding.EncodeToString(id.AESKey)
+}
+
+func parseIdentity(name string, exported string) (Identity, error) {
+	parts := strings.Split(exported, ".")
+	if len(parts) != 2 {
+		return Identity{}, &InvalidIdentityError{Reason: "expected <signing key>.<AES key>"}
+	}
+	seed, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return Identity{}, &InvalidIdentityError{Reason: "bad signing key"}
+	}
+	aesKey, err := ImportAESKey(parts[1])
+	if err != nil {
+		return Identity{}, err
+	}
+	return Identity{Name: name, SigningKey: ed25519.NewKeyFromSeed(seed), AESKey: aesKey}, nil
+}
+
+// Keyring is a set of named identities, one of which is the default
+type Keyring struct {
+	Default    string              `json:"default"`
+	Identities map[string]Identity `json:"identities"`
+}
+
+type sealedKeyring struct {
+	Version    int    `json:"version"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{Identities: make(map[string]Identity)}
+}
+
+// DefaultKeyringPath is where the keyring lives unless told otherwise
+func DefaultKeyringPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	return filepath.Join(home, ".eternity", "keyring.json")
+}
+
+// pbkdf2 derives a key from a passphrase (RFC 8018 with HMAC-SHA256), one
+// block is all we need
+func pbkdf2(passphrase []byte, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, passphrase)
+	prf.Write(salt)
+	block := make([]byte, 4)
+	binary.BigEndian.PutUint32(block, 1)
+	prf.Write(block)
+	u := prf.Sum(nil)
+
+	key := make([]byte, len(u))
+	copy(key, u)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+func keyringCipher(passphrase []byte, salt []byte, iterations int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2(passphrase, salt, iterations))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// LoadKeyring reads and decrypts the keyring at path
+func LoadKeyring(path string, passphrase []byte) (*Keyring, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sealed := sealedKeyring{}
+	if err := json.Unmarshal(raw, &sealed); err != nil {
+		return nil, err
+	}
+	if sealed.Version != keyringVersion {
+		return nil, &UnsupportedKeyringError{Version: sealed.Version}
+	}
+	if sealed.Iterations < minKeyringIterations || sealed.Iterations > maxKeyringIterations {
+		return nil, &KeyringIterationsError{Iterations: sealed.Iterations}
+	}
+
+	gcm, err := keyringCipher(passphrase, sealed.Salt, sealed.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed.Nonce) != gcm.NonceSize() {
+		return nil, &WrongPassphraseError{}
+	}
+	plain, err := gcm.Open(nil, sealed.Nonce, sealed.Ciphertext, nil)
+	if err != nil {
+		return nil, &WrongPassphraseError{}
+	}
+
+	k := NewKeyring()
+	if err := json.Unmarshal(plain, k); err != nil {
+		return nil, err
+	}
+	if k.Identities == nil {
+		k.Identities = make(map[string]Identity)
+	}
+	return k, nil
+}
+
+// Save encrypts the keyring with the passphrase and writes it to path,
+// replacing what was there only once the new keyring is fully written
+func (k *Keyring) Save(path string, passphrase []byte) error {
+	plain, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+
+	sealed := sealedKeyring{
+		Version:    keyringVersion,
+		Iterations: KeyringIterations,
+		Salt:       make([]byte, 16),
+	}
+	if _, err := rand.Read(sealed.Salt); err != nil {
+		return err
+	}
+	gcm, err := keyringCipher(passphrase, sealed.Salt, sealed.Iterations)
+	if err != nil {
+		return err
+	}
+	sealed.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(sealed.Nonce); err != nil {
+		return err
+	}
+	sealed.Ciphertext = gcm.Seal(nil, sealed.Nonce, plain, nil)
+
+	out, err := json.MarshalIndent(sealed, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, out)
+}
+
+// writeFileAtomic replaces the file at path with data, after a crash the
+// old or the new keyring is there, never a part of one
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if syncErr := tmp.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// the rename is only durable once the directory is synced
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// add puts an identity in the keyring, the first one becomes the default
+func (k *Keyring) add(id Identity) error {
+	if _, ok := k.Identities[id.Name]; ok {
+		return &IdentityExistsError{Name: id.Name}
+	}
+	k.Identities[id.Name] = id
+	if k.Default == "" {
+		k.Default = id.Name
+	}
+	return nil
+}
+
+// Generate makes a new identity with fresh keys
+func (k *Keyring) Generate(name string) (Identity, error) {
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return Identity{}, err
+	}
+	aesKey, err := GenerateAESKey()
+	if err != nil {
+		return Identity{}, err
+	}
+	id := Identity{Name: name, SigningKey: signingKey, AESKey: aesKey}
+	return id, k.add(id)
+}
+
+// ImportIdentity adds an identity made by Identity.Export
+func (k *Keyring) ImportIdentity(name string, exported string) (Identity, error) {
+	id, err := parseIdentity(name, exported)
+	if err != nil {
+		return Identity{}, err
+	}
+	return id, k.add(id)
+}
+
+// ImportAES replaces the AES key of an identity, for reading files that
+// were encrypted with a key exported by ExportAESKey
+func (k *Keyring) ImportAES(name string, exported string) error {
+	id, err := k.Identity(name)
+	if err != nil {
+		return err
+	}
+	aesKey, err := ImportAESKey(exported)
+	if err != nil {
+		return err
+	}
+	id.AESKey = aesKey
+	k.Identities[name] = id
+	return nil
+}
+
+func (k *Keyring) Identity(name string) (Identity, error) {
+	id, ok := k.Identities[name]
+	if !ok {
+		return Identity{}, &IdentityNotFoundError{Name: name}
+	}
+	return id, nil
+}
+
+func (k *Keyring) DefaultIdentity() (Identity, error) {
+	if k.Default == "" {
+		return Identity{}, &NoDefaultIdentityError{}
+	}
+	return k.Identity(k.Default)
+}
+
+func (k *Keyring) SetDefault(name string) error {
+	if _, err := k.Identity(name); err != nil {
+		return err
+	}
+	k.Default = name
+	return nil
+}
+
+// Remove deletes an identity, removing the default leaves the keyring
+// without one
+func (k *Keyring) Remove(name string) error {
+	if _, err := k.Identity(name); err != nil {
+		return err
+	}
+	delete(k.Identities, name)
+	if k.Default == name {
+		k.Default = ""
+	}
+	return nil
+}
+
+// Names lists the identities in the keyring in order
+func (k *Keyring) Names() []string {
+	names := make([]string, 0, len(k.Identities))
+	for name := range k.Identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ClientVars are the client vars for the default identity, store and
+// delete requests made with them are signed by it
+func (k *Keyring) ClientVars(serverAddress string) (ClientVars, error) {
+	id, err := k.DefaultIdentity()
+	if err != nil {
+		return ClientVars{}, err
+	}
+	return id.Vars(serverAddress), nil
+}
@@ -0,0 +1,106 @@
+package nymRequests
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyringSaveReplaces(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keyring.json")
+	pass := []byte("passphrase")
+
+	k := NewKeyring()
+	alice, err := k.Generate("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Save(path, pass); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	bob, err := k.ImportIdentity("bob", alice.Export())
+	if err != nil {
+		t.Fatalf("ImportIdentity: %v", err)
+	}
+	if err := k.SetDefault("bob"); err != nil {
+		t.Fatalf("SetDefault: %v", err)
+	}
+	if err := k.Save(path, pass); err != nil {
+		t.Fatalf("Save again: %v", err)
+	}
+
+	loaded, err := LoadKeyring(path, pass)
+	if err != nil {
+		t.Fatalf("LoadKeyring: %v", err)
+	}
+	id, err := loaded.DefaultIdentity()
+	if err != nil || id.Name != "bob" || !id.SigningKey.Equal(bob.SigningKey) {
+		t.Fatalf("default identity %q, %v, want bob", id.Name, err)
+	}
+	if len(loaded.Names()) != 2 {
+		t.Fatalf("identities %v, want alice and bob", loaded.Names())
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("%d files next to the keyring, temporary files left behind", len(files)-1)
+	}
+}
+
+func TestLoadKeyringRefusesIterations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	pass := []byte("passphrase")
+	k := NewKeyring()
+	if _, err := k.Generate("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Save(path, pass); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sealed sealedKeyring
+	if err := json.Unmarshal(raw, &sealed); err != nil {
+		t.Fatal(err)
+	}
+
+	var wrongErr *WrongPassphraseError
+	if _, err := LoadKeyring(path, []byte("not the passphrase")); !errors.As(err, &wrongErr) {
+		t.Fatalf("LoadKeyring with the wrong passphrase: %v, want WrongPassphraseError", err)
+	}
+
+	tests := []struct {
+		name       string
+		iterations int
+		want       interface{}
+	}{
+		{"none", 0, new(*KeyringIterationsError)},
+		{"one", 1, new(*KeyringIterationsError)},
+		{"below the minimum", minKeyringIterations - 1, new(*KeyringIterationsError)},
+		{"above the maximum", maxKeyringIterations + 1, new(*KeyringIterationsError)},
+		{"huge", 1 << 62, new(*KeyringIterationsError)},
+		{"negative", -1, new(*KeyringIterationsError)},
+		// in range, but not what the keyring was sealed with
+		{"changed", KeyringIterations + 1, new(*WrongPassphraseError)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed := sealed
+			changed.Iterations = tt.iterations
+			out, err := json.Marshal(changed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			changedPath := filepath.Join(t.TempDir(), "keyring.json")
+			if err := ioutil.WriteFile(changedPath, out, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadKeyring(changedPath, pass); !errors.As(err, tt.want) {
+				t.Fatalf("LoadKeyring: %v, want %T", err, tt.want)
+			}
+		})
+	}
+}
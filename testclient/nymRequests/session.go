@@ -0,0 +1,334 @@
+package nymRequests
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"eternity/eternityProto"
+	"eternity/nymProto"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const DefaultNymURI = "ws://localhost:1977"
+
+// DefaultTimeout is how long we wait for a reply to come back through the
+// mixnet before giving up on a request
+const DefaultTimeout = 2 * time.Minute
+
+type NoSigningKeyError struct{}
+
+func (e *NoSigningKeyError) Error() string {
+	return "no ED25519 private key to sign the request with"
+}
+
+type TimeoutError struct {
+	ID     uint64
+	Action eternityProto.Action
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out waiting for a reply to %s request %d", e.Action, e.ID)
+}
+
+type SessionClosedError struct {
+	Err error // the error that closed the connection, if any
+}
+
+func (e *SessionClosedError) Error() string {
+	if e.Err == nil {
+		return "session closed"
+	}
+	return fmt.Sprintf("session closed: %v", e.Err)
+}
+
+type HashMismatchError struct{}
+
+func (e *HashMismatchError) Error() string {
+	return "file received from the server does not match the requested hash"
+}
+
+// Session is a connection to our nym client used to talk to one eternity
+// server. Requests can be made from several goroutines at once, replies are
+// matched to their request by ID.
+type Session struct {
+	Vars    ClientVars
+	Timeout time.Duration
+
+	conn      *websocket.Conn
+	recipient []byte
+	writeMut  sync.Mutex // mutex for writing to the connection
+
+	mut     sync.Mutex // guards nextID, pending and readErr
+	nextID  uint64
+	pending map[uint64]chan eternityProto.Response
+	readErr error
+	closed  chan struct{}
+}
+
+// Connect dials the nym client at uri and starts a session with the server
+// in cV.ServerAddress
+func (cV ClientVars) Connect(uri string) (*Session, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewSession(conn, cV)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewSession starts a session over an already open nym client connection,
+// the session takes ownership of the connection
+func NewSession(conn *websocket.Conn, cV ClientVars) (*Session, error) {
+	recipient, err := nymProto.ParseRecipient(cV.ServerAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	// start the IDs somewhere random so replies meant for an earlier
+	// session are not mistaken for ours
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		Vars:      cV,
+		Timeout:   DefaultTimeout,
+		conn:      conn,
+		recipient: recipient,
+		nextID:    binary.BigEndian.Uint64(idBytes),
+		pending:   make(map[uint64]chan eternityProto.Response),
+		closed:    make(chan struct{}),
+	}
+	go s.readLoop()
+	return s, nil
+}
+
+func (s *Session) Close() error {
+	return s.conn.Close()
+}
+
+// Done is closed once the connection to the nym client is gone, requests
+// made after that fail with SessionClosedError
+func (s *Session) Done() <-chan struct{} {
+	return s.closed
+}
+
+func (s *Session) readLoop() {
+	for {
+		_, raw, err := s.conn.ReadMessage()
+		if err != nil {
+			s.mut.Lock()
+			s.readErr = err
+			s.mut.Unlock()
+			close(s.closed)
+			return
+		}
+
+		received, err := nymProto.ParseReceived(raw)
+		if err != nil {
+			log.Printf("ignoring frame from nym client: %v", err)
+			continue
+		}
+		resp, err := eternityProto.DecodeResponse(received.Message)
+		if err != nil {
+			log.Printf("ignoring message that is not an eternity response: %v", err)
+			continue
+		}
+
+		s.mut.Lock()
+		ch, ok := s.pending[resp.ID]
+		delete(s.pending, resp.ID)
+		s.mut.Unlock()
+		if ok {
+			ch <- resp
+		}
+	}
+}
+
+// Do sends a request to the server and waits for its response, the request
+// ID is filled in by the session
+func (s *Session) Do(req eternityProto.Request) (eternityProto.Response, error) {
+	ch := make(chan eternityProto.Response, 1)
+
+	s.mut.Lock()
+	req.ID = s.nextID
+	s.nextID++
+	s.pending[req.ID] = ch
+	s.mut.Unlock()
+
+	forget := func() {
+		s.mut.Lock()
+		delete(s.pending, req.ID)
+		s.mut.Unlock()
+	}
+
+	sendRequest := nymProto.MakeSendRequest(s.recipient, req.Encode(), true)
+	s.writeMut.Lock()
+	err := s.conn.WriteMessage(websocket.BinaryMessage, sendRequest)
+	s.writeMut.Unlock()
+	if err != nil {
+		forget()
+		return eternityProto.Response{}, err
+	}
+
+	timer := time.NewTimer(s.Timeout)
+	defer timer.Stop()
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-timer.C:
+		forget()
+		return eternityProto.Response{}, &TimeoutError{ID: req.ID, Action: req.Action}
+	case <-s.closed:
+		forget()
+		s.mut.Lock()
+		defer s.mut.Unlock()
+		return eternityProto.Response{}, &SessionClosedError{Err: s.readErr}
+	}
+}
+
+func (cV ClientVars) signingKey() (ed25519.PrivateKey, error) {
+	if len(cV.Privkey) != ed25519.PrivateKeySize {
+		return nil, &NoSigningKeyError{}
+	}
+	return cV.Privkey, nil
+}
+
+// readSignature signs for reading a private file of ours, public reads are
+// sent without one
+func (s *Session) readSignature(req eternityProto.Request, hash []byte, private bool) (eternityProto.Request, error) {
+	if !private {
+		return req, nil
+	}
+	privKey, err := s.Vars.signingKey()
+	if err != nil {
+		return req, err
+	}
+	return req.Set(eternityProto.FieldSignature, ed25519.Sign(privKey, eternityProto.ReadSignatureData(hash))), nil
+}
+
+func visibility(private bool) []byte {
+	if private {
+		return []byte{byte(eternityProto.VisibilityPrivate)}
+	}
+	return []byte{byte(eternityProto.VisibilityPublic)}
+}
+
+// Search asks the server if it holds the public file with the given SHA-256
+// hash
+func (s *Session) Search(hash []byte) (bool, error) {
+	return s.search(hash, false)
+}
+
+// SearchPrivate asks the server if it holds a private file of ours
+func (s *Session) SearchPrivate(hash []byte) (bool, error) {
+	return s.search(hash, true)
+}
+
+func (s *Session) search(hash []byte, private bool) (bool, error) {
+	req, err := s.readSignature(eternityProto.NewSearchRequest(0, hash), hash, private)
+	if err != nil {
+		return false, err
+	}
+	resp, err := s.Do(req)
+	if err != nil {
+		return false, err
+	}
+	if resp.Status == eternityProto.StatusNotFound {
+		return false, nil
+	}
+	return resp.Status == eternityProto.StatusOK, resp.Err()
+}
+
+// Store uploads a public file signed with our private key and returns the
+// SHA-256 hash the server stored it under
+func (s *Session) Store(file []byte) ([]byte, error) {
+	return s.store(file, false)
+}
+
+// StorePrivate uploads a file only we can find and read back
+func (s *Session) StorePrivate(file []byte) ([]byte, error) {
+	return s.store(file, true)
+}
+
+func (s *Session) store(file []byte, private bool) ([]byte, error) {
+	privKey, err := s.Vars.signingKey()
+	if err != nil {
+		return nil, err
+	}
+	fileHash := sha256.Sum256(file)
+	sig := ed25519.Sign(privKey, fileHash[:])
+	publicKey := privKey.Public().(ed25519.PublicKey)
+
+	req := eternityProto.NewStoreRequest(0, publicKey, sig, file).
+		Set(eternityProto.FieldVisibility, visibility(private))
+	resp, err := s.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := resp.Err(); err != nil {
+		return nil, err
+	}
+	return resp.Get(eternityProto.FieldHash), nil
+}
+
+// Serve downloads the public file with the given SHA-256 hash and checks
+// that the file we got back matches it
+func (s *Session) Serve(hash []byte) ([]byte, error) {
+	return s.serve(hash, false)
+}
+
+// ServePrivate downloads a private file of ours
+func (s *Session) ServePrivate(hash []byte) ([]byte, error) {
+	return s.serve(hash, true)
+}
+
+func (s *Session) serve(hash []byte, private bool) ([]byte, error) {
+	req, err := s.readSignature(eternityProto.NewServeRequest(0, hash), hash, private)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := resp.Err(); err != nil {
+		return nil, err
+	}
+
+	file := resp.Get(eternityProto.FieldBody)
+	fileHash := sha256.Sum256(file)
+	if !bytes.Equal(fileHash[:], hash) {
+		return nil, &HashMismatchError{}
+	}
+	return file, nil
+}
+
+// Delete removes a file we stored, the hash and the current time are
+// signed with our private key
+func (s *Session) Delete(hash []byte) error {
+	privKey, err := s.Vars.signingKey()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	sig := ed25519.Sign(privKey, eternityProto.DeleteSignatureData(hash, now))
+
+	resp, err := s.Do(eternityProto.NewDeleteRequest(0, hash, now, sig))
+	if err != nil {
+		return err
+	}
+	return resp.Err()
+}
@@ -0,0 +1,228 @@
+package nymRequests
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"eternity/eternityProto"
+	"eternity/fakeNym"
+	"eternity/nymLib"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// startServer runs an eternity server on a new client of the mixnet and
+// returns its address
+func startServer(t *testing.T, mixnet *fakeNym.Mixnet) string {
+	t.Helper()
+	nymClient, err := mixnet.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := nymClient.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsh, err := nymLib.NewWebsocketHandler(conn, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsh.Dial = nymClient.Dial
+	ctx, cancel := context.WithCancel(context.Background())
+	wsh.Start(ctx)
+	t.Cleanup(func() {
+		cancel()
+		<-wsh.Done()
+		nymClient.Close()
+	})
+	return nymClient.AddressString()
+}
+
+// newSession connects a new identity to the server through its own client
+// of the mixnet
+func newSession(t *testing.T, mixnet *fakeNym.Mixnet, server string) *Session {
+	t.Helper()
+	nymClient, err := mixnet.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := NewKeyring().Generate("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := nymClient.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSession(conn, id.Vars(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Timeout = 5 * time.Second
+	t.Cleanup(func() {
+		s.Close()
+		nymClient.Close()
+	})
+	return s
+}
+
+func hashOf(file []byte) []byte {
+	hash := sha256.Sum256(file)
+	return hash[:]
+}
+
+// wantStatus fails the test unless err is a response with the status
+func wantStatus(t *testing.T, err error, status eternityProto.Status) {
+	t.Helper()
+	var statusErr *eternityProto.StatusError
+	if !errors.As(err, &statusErr) || statusErr.Status != status {
+		t.Fatalf("got error %v, want status %v", err, status)
+	}
+}
+
+func TestStoreSearchServeDelete(t *testing.T) {
+	mixnet := fakeNym.NewMixnet()
+	defer mixnet.Close()
+	s := newSession(t, mixnet, startServer(t, mixnet))
+
+	file := []byte("a public file")
+	hash, err := s.Store(file)
+	if err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if !bytes.Equal(hash, hashOf(file)) {
+		t.Fatalf("stored as %x, want %x", hash, hashOf(file))
+	}
+
+	if found, err := s.Search(hash); err != nil || !found {
+		t.Fatalf("Search: %v, %v", found, err)
+	}
+	served, err := s.Serve(hash)
+	if err != nil {
+		t.Fatalf("Serve: %v", err)
+	}
+	if !bytes.Equal(served, file) {
+		t.Fatalf("served %q, want %q", served, file)
+	}
+
+	if err := s.Delete(hash); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if found, err := s.Search(hash); err != nil || found {
+		t.Fatalf("Search after delete: %v, %v", found, err)
+	}
+	_, err = s.Serve(hash)
+	wantStatus(t, err, eternityProto.StatusNotFound)
+}
+
+func TestDeleteByAnotherKey(t *testing.T) {
+	mixnet := fakeNym.NewMixnet()
+	defer mixnet.Close()
+	server := startServer(t, mixnet)
+	owner := newSession(t, mixnet, server)
+	other := newSession(t, mixnet, server)
+
+	hash, err := owner.Store([]byte("mine"))
+	if err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	wantStatus(t, other.Delete(hash), eternityProto.StatusBadSignature)
+	if found, err := other.Search(hash); err != nil || !found {
+		t.Fatalf("file gone after a delete by another key: %v, %v", found, err)
+	}
+}
+
+func TestStoreByAnotherKey(t *testing.T) {
+	mixnet := fakeNym.NewMixnet()
+	defer mixnet.Close()
+	server := startServer(t, mixnet)
+	owner := newSession(t, mixnet, server)
+	other := newSession(t, mixnet, server)
+
+	hash, err := owner.Store([]byte("mine"))
+	if err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	_, err = other.StorePrivate([]byte("mine"))
+	wantStatus(t, err, eternityProto.StatusConflict)
+	if found, err := other.Search(hash); err != nil || !found {
+		t.Fatalf("file hidden after a store by another key: %v, %v", found, err)
+	}
+}
+
+func TestPrivateFiles(t *testing.T) {
+	mixnet := fakeNym.NewMixnet()
+	defer mixnet.Close()
+	server := startServer(t, mixnet)
+	owner := newSession(t, mixnet, server)
+	other := newSession(t, mixnet, server)
+
+	file := []byte("a private file")
+	hash, err := owner.StorePrivate(file)
+	if err != nil {
+		t.Fatalf("StorePrivate: %v", err)
+	}
+
+	if found, err := owner.SearchPrivate(hash); err != nil || !found {
+		t.Fatalf("owner SearchPrivate: %v, %v", found, err)
+	}
+	if served, err := owner.ServePrivate(hash); err != nil || !bytes.Equal(served, file) {
+		t.Fatalf("owner ServePrivate: %q, %v", served, err)
+	}
+
+	// to everyone else the file does not exist
+	if found, err := other.Search(hash); err != nil || found {
+		t.Fatalf("Search without a signature: %v, %v", found, err)
+	}
+	if found, err := other.SearchPrivate(hash); err != nil || found {
+		t.Fatalf("SearchPrivate by another key: %v, %v", found, err)
+	}
+	if _, err := other.Serve(hash); err == nil {
+		t.Fatalf("private file served without a signature")
+	}
+	if _, err := other.ServePrivate(hash); err == nil {
+		t.Fatalf("private file served to another key")
+	}
+
+	if err := owner.Delete(hash); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if found, err := owner.SearchPrivate(hash); err != nil || found {
+		t.Fatalf("SearchPrivate after delete: %v, %v", found, err)
+	}
+}
+
+func TestUploadDownload(t *testing.T) {
+	mixnet := fakeNym.NewMixnet()
+	defer mixnet.Close()
+	s := newSession(t, mixnet, startServer(t, mixnet))
+
+	file := testFile(3*eternityProto.DefaultChunkSize+1234, 1)
+	hash, err := s.Upload(file)
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if !bytes.Equal(hash, hashOf(file)) {
+		t.Fatalf("uploaded as %x, want %x", hash, hashOf(file))
+	}
+	downloaded, err := s.Download(hash)
+	if err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if !bytes.Equal(downloaded, file) {
+		t.Fatalf("downloaded file differs from the upload")
+	}
+	missing, err := s.UploadStatus(hash)
+	if err != nil || len(missing) != 0 {
+		t.Fatalf("UploadStatus: %v, %v", missing, err)
+	}
+}
+
+// testFile is size bytes of repeatable noise
+func testFile(size int, seed int64) []byte {
+	file := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(file)
+	return file
+}